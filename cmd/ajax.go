@@ -6,12 +6,10 @@ package main
  */
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os/exec"
-	"strings"
 
 	"github.com/labstack/echo/v4"
 )
@@ -24,11 +22,22 @@ func vendors(c echo.Context) error {
 	return c.JSONPretty(http.StatusOK, venlist, " ")
 }
 
+/*
+ * Return the resolved ServerMap for a vendor with latency stats
+ */
+func tree(c echo.Context) error {
+	vc, err := getVendorConfig(pathParam(c, "vendor"))
+	if err != nil {
+		return c.String(http.StatusNotFound, err.Error())
+	}
+	return c.JSONPretty(http.StatusOK, vc.Servers.Tree(vc.Name, false), " ")
+}
+
 /*
  * For tie given vendor, return a list of Levels
  */
 func levels(c echo.Context) error {
-	vendor := c.Param("vendor")
+	vendor := pathParam(c, "vendor")
 	l := Levels(vendor)
 	return c.JSONPretty(http.StatusOK, l, " ")
 }
@@ -49,15 +58,8 @@ func url(command string, c echo.Context) string {
  * For the given vendor/level, return the keys of the level below
  */
 func level(c echo.Context) error {
-	vendor := c.Param("vendor")
-	var path []string
-	log.Printf("param names: %s", string(strings.Join(c.ParamNames(), ", ")))
-	for _, pname := range c.ParamNames() {
-		if pname == "vendor" {
-			continue
-		}
-		path = append(path, strings.ReplaceAll(c.Param(pname), "+", " "))
-	}
+	vendor := pathParam(c, "vendor")
+	path := scopeParam(c)
 	keys, err := GetPathKeys(vendor, path)
 	if err != nil {
 		return c.String(http.StatusNotFound, err.Error())
@@ -113,19 +115,8 @@ func speedtest(c echo.Context) error {
  * Returns the server(s) for the given vendor and level
  */
 func servers(c echo.Context) error {
-	vendor := c.Param("vendor")
-	levels := Levels(vendor)
-	log.Printf("%s has %d levels", vendor, len(levels))
-	log.Printf("param names: %s", string(strings.Join(c.ParamNames(), ", ")))
-	var path []string
-	for i, pname := range c.ParamNames() {
-		if pname == "vendor" {
-			continue
-		}
-		log.Printf("adding %d %s to path", i, pname)
-		path = append(path, strings.ReplaceAll(c.Param(pname), "+", " "))
-	}
-
+	vendor := pathParam(c, "vendor")
+	path := scopeParam(c)
 	servers, err := GetServers(vendor, path)
 	if err != nil {
 		return c.String(http.StatusNotFound, err.Error())
@@ -142,54 +133,28 @@ func servers(c echo.Context) error {
 }
 
 func exits(c echo.Context) error {
-	exitMap, _, err := _exits(c)
+	level, err := configLevel(pathParam(c, "vendor"), []string{})
 	if err != nil {
-		return c.String(http.StatusInternalServerError, err.Error())
-	}
-	jdata, err := json.Marshal(exitMap)
-	if err != nil {
-		return c.String(http.StatusInternalServerError, err.Error())
-	}
-
-	return c.JSONPretty(http.StatusOK, jdata, " ")
-}
-
-func _exits(c echo.Context) (interface{}, int, error) {
-	vendor := c.Param("vendor")
-	levels := Levels(vendor)
-	vpath := vendor + ".servers"
-	lvls := len(levels)
-	switch lvls {
-	case 0:
-		log.Printf("getting servers for %s", vendor)
-		data := Konf.Strings(vpath)
-		return data, 0, nil
-	case 1, 2, 3, 4, 5:
-		data := walkLevels(vpath, lvls, 1)
-		return data, lvls, nil
-	default:
-		return nil, 0, fmt.Errorf("Invalid number of vendor levels for %s", vendor)
+		return c.String(http.StatusNotFound, err.Error())
 	}
+	return c.JSONPretty(http.StatusOK, walkLevels(level), " ")
 }
 
 /*
- * Recursively walk the vendor.servers hash map and return
+ * Recursively walk the vendor.servers levels and return a list of the
+ * servers for a location or a map of the sub-levels.  Servers listed next
+ * to sub-levels are under the "" key.
  */
-
-func walkLevels(path string, levels int, depth int) interface{} {
-	if levels <= depth {
-		// this level is a map[string]interface
-		us := make(map[string]interface{}, 0)
-		keys := Konf.MapKeys(path)
-		for _, key := range keys {
-			newpath := path + "." + key
-			fmt.Printf("going deeper: %s\n", newpath)
-			us[key] = walkLevels(newpath, levels, depth+1)
-		}
-		return us
-	} else {
-		// this level is the final level and a map[string][]string
-		us := Konf.StringsMap(path)
-		return us
+func walkLevels(level *ServerLevel) interface{} {
+	if len(level.Levels) == 0 {
+		return level.Servers
+	}
+	us := make(map[string]interface{}, 0)
+	for key, child := range level.Levels {
+		us[key] = walkLevels(child)
+	}
+	if len(level.Servers) > 0 {
+		us[""] = level.Servers
 	}
+	return us
 }
@@ -2,44 +2,75 @@ package main
 
 import (
 	"log"
-	"net"
-	"regexp"
+
+	"github.com/synfinatic/vpnexiter/vpn"
 )
 
 type ServerList struct {
 	Name string
+	IDs  map[string]string // server => exit ID
 	IPs  map[string][]string
+	IPv4 map[string][]string
+	IPv6 map[string][]string
+	// servers which can't be selected
+	Unavailable map[string]ServerStatus
+	// servers given as a map in the config
+	Info map[string]vpn.ServerInfo
 }
 
 func Server2ServerList(vendor string, path []string) (*ServerList, error) {
 	slist := ServerList{}
+	slist.IDs = make(map[string]string)
 	slist.IPs = make(map[string][]string)
+	slist.IPv4 = make(map[string][]string)
+	slist.IPv6 = make(map[string][]string)
+	slist.Unavailable = make(map[string]ServerStatus)
+	slist.Info = make(map[string]vpn.ServerInfo)
 	name, err := GetPath(vendor, path)
 	if err != nil {
 		return nil, err
 	}
 	slist.Name = name
-	servers, err := GetServers(vendor, path)
+	level, err := configLevel(vendor, path)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, s := range servers {
-		ips, err := net.LookupHost(s)
+	// for the probe_failing status
+	var node *ServerMap
+	if vc, err := getVendorConfig(vendor); err == nil {
+		node, _ = vc.Servers.getNode(path)
+	}
+
+	family := vpn.AddressFamily(Konf, vendor)
+	for _, s := range level.Servers {
+		slist.IDs[s] = exitID(vendor, append(append([]string{}, path...), s))
+		info, ok := level.Info[s]
+		if ok {
+			slist.Info[s] = info
+		}
+		if disabledServer(vendor, s) {
+			slist.Unavailable[s] = ServerStatus{Status: StatusDisabled, LastError: "listed in disabled_servers"}
+			continue
+		} else if ok && !info.Enabled {
+			slist.Unavailable[s] = ServerStatus{Status: StatusDisabled, LastError: "enabled: false"}
+			continue
+		}
+		// IP addresses get returned as-is
+		ips, err := vpn.ResolveHost(s, family)
 		if err != nil {
-			// failed to resolve
-			isIP, _ := regexp.Match(`\d+\.\d+\.\d+\.\d+`, []byte(s))
-			if !isIP {
-				// weren't able to resolve a FQDN
-				log.Printf("Unable to resolve: %s", s)
-				continue
-			}
-			// IP addresses get added as-is
-			l := []string{s}
-			slist.IPs[s] = l
+			log.Printf("Unable to resolve: %s: %s", s, err.Error())
+			slist.Unavailable[s] = ServerStatus{Status: StatusUnresolvable, LastError: err.Error()}
 			continue
 		}
 		slist.IPs[s] = ips
+		slist.IPv4[s], slist.IPv6[s] = vpn.SplitFamilies(ips)
+		if node == nil {
+			continue
+		}
+		if ss, bad := node.serverStatus(s); bad {
+			slist.Unavailable[s] = ss
+		}
 	}
 	return &slist, nil
 }
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+/*
+ * A single server in the ServerMap along with the IPs it resolves to
+ */
+type ServerRef struct {
+	Vendor string
+	Path   []string // location + server
+	Server string
+	ID     string // exit ID
+	IPs    []string
+}
+
+/*
+ * Returns every usable server at or below scope for the vendor
+ */
+func scopeServers(vendor string, scope []string) ([]ServerRef, error) {
+	vc, err := getVendorConfig(vendor)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = vc.Servers.getNode(scope); err != nil {
+		return nil, err
+	}
+	refs := []ServerRef{}
+	for _, loc := range vc.Servers.locations(scope) {
+		node, err := vc.Servers.getNode(loc)
+		if err != nil {
+			continue
+		}
+		for _, server := range node.usableServers(node.locationServers()) {
+			path := append(append([]string{}, loc...), server)
+			refs = append(refs, ServerRef{
+				Vendor: vendor,
+				Path:   path,
+				Server: server,
+				ID:     exitID(vendor, path),
+				IPs:    serverIPs(vendor, server, path),
+			})
+		}
+	}
+	return refs, nil
+}
+
+/*
+ * Candidates are scored as:
+ *
+ *   latency * avg RTT ms + jitter * jitter ms + loss * % loss
+ *     - download * Mbps - upload * Mbps
+ *
+ * where the Mbps come from past speedtests.  Lowest score wins.
+ */
+type ScoreWeights struct {
+	Latency  float64
+	Jitter   float64
+	Loss     float64
+	Download float64
+	Upload   float64
+}
+
+func getScoreWeights() ScoreWeights {
+	sw := ScoreWeights{
+		Latency:  1.0,
+		Jitter:   0.5,
+		Loss:     10.0,
+		Download: 0.1,
+		Upload:   0.0,
+	}
+	for key, weight := range map[string]*float64{
+		"latency":  &sw.Latency,
+		"jitter":   &sw.Jitter,
+		"loss":     &sw.Loss,
+		"download": &sw.Download,
+		"upload":   &sw.Upload,
+	} {
+		if Konf.Exists("auto_select.weights." + key) {
+			*weight = Konf.Float64("auto_select.weights." + key)
+		}
+	}
+	return sw
+}
+
+type Candidate struct {
+	Vendor       string
+	Path         []string
+	Server       string
+	ID           string // exit ID
+	IP           string
+	LatencyMs    float64
+	JitterMs     float64
+	Loss         float64
+	DownloadMbps float64
+	UploadMbps   float64
+	HasSpeedtest bool
+	Score        float64
+	Down         bool
+}
+
+func (c Candidate) ScoreStr() string {
+	if c.Down {
+		return "down"
+	}
+	return fmt.Sprintf("%.02f", c.Score)
+}
+
+type AutoSelectResult struct {
+	Scope      string
+	Time       time.Time
+	Candidates []Candidate // best first
+	Selected   string
+	Error      string
+}
+
+// the n best candidates, for the status page
+func (asr *AutoSelectResult) Top(n int) []Candidate {
+	if len(asr.Candidates) < n {
+		return asr.Candidates
+	}
+	return asr.Candidates[:n]
+}
+
+func (sw ScoreWeights) score(c *Candidate, lr LatencyResult) {
+	c.IP = lr.IP
+	c.LatencyMs = lr.AvgMs()
+	c.JitterMs = lr.JitterMs()
+	c.Loss = lr.Loss()
+	c.Down = lr.Recv() == 0
+	if c.Down {
+		c.Score = 0
+		return
+	}
+	c.Score = sw.Latency*c.LatencyMs + sw.Jitter*c.JitterMs + sw.Loss*c.Loss -
+		sw.Download*c.DownloadMbps - sw.Upload*c.UploadMbps
+}
+
+/*
+ * Probe every server in the scope and rank them best first
+ */
+func rankExits(vendor string, scope []string) (*AutoSelectResult, error) {
+	refs, err := scopeServers(vendor, scope)
+	if err != nil {
+		return nil, err
+	}
+	ips := []string{}
+	seen := map[string]bool{}
+	for _, ref := range refs {
+		for _, ip := range ref.IPs {
+			if !seen[ip] {
+				seen[ip] = true
+				ips = append(ips, ip)
+			}
+		}
+	}
+
+	lp := getLatencyProbe("auto_select")
+	concurrency := 10
+	if Konf.Int("auto_select.concurrency") > 0 {
+		concurrency = Konf.Int("auto_select.concurrency")
+	}
+	log.Printf("Auto-select probing %d IPs for %d servers in %s / %s",
+		len(ips), len(refs), vendor, strings.Join(scope, " / "))
+	latency := lp.MeasureAll(ips, concurrency)
+
+	sw := getScoreWeights()
+	result := &AutoSelectResult{
+		Scope:      strings.Join(append([]string{vendor}, scope...), " / "),
+		Time:       time.Now(),
+		Candidates: []Candidate{},
+	}
+	for _, ref := range refs {
+		c := Candidate{
+			Vendor: vendor,
+			Path:   ref.Path,
+			Server: ref.Server,
+			ID:     ref.ID,
+			Down:   true,
+		}
+		c.DownloadMbps, c.UploadMbps, c.HasSpeedtest = speedtestAverage(vendor, ref.ID, append([]string{ref.Server}, ref.IPs...))
+		// use the best IP for the server
+		for _, ip := range ref.IPs {
+			try := c
+			sw.score(&try, latency[ip])
+			if len(c.IP) == 0 || (!try.Down && (c.Down || try.Score < c.Score)) {
+				c = try
+			}
+		}
+		result.Candidates = append(result.Candidates, c)
+	}
+	sort.SliceStable(result.Candidates, func(i, j int) bool {
+		a, b := result.Candidates[i], result.Candidates[j]
+		if a.Down != b.Down {
+			return !a.Down
+		}
+		return a.Score < b.Score
+	})
+	return result, nil
+}
+
+/*
+ * Rank the exits in scope and switch to the best one that comes up
+ */
+func autoSelect(vendor string, scope []string) (*AutoSelectResult, error) {
+	result, err := rankExits(vendor, scope)
+	if err != nil {
+		return nil, err
+	}
+	GS.AutoSelect = result
+
+	switchMux.Lock()
+	defer switchMux.Unlock()
+	sp := getSwitchPolicy()
+	for _, c := range result.Candidates {
+		if c.Down {
+			break
+		}
+		err = trySwitchWithRetries(sp, vendor, c.Server, c.Path)
+		if err == nil {
+			result.Selected = c.Server
+			log.Printf("Auto-selected %s (score %s)", strings.Join(c.Path, " / "), c.ScoreStr())
+			return result, nil
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("Every server in %s is down", result.Scope)
+	}
+	result.Error = err.Error()
+	return result, err
+}
+
+/*
+ * UI: switch to the best exit in the scope
+ */
+func AutoSelect(c echo.Context) error {
+	vendor := pathParam(c, "vendor")
+	_, err := requestSwitch(c, func() (string, error) {
+		result, err := autoSelect(vendor, scopeParam(c))
+		if err != nil {
+			return "", err
+		}
+		return result.Selected, nil
+	})
+	if err != nil {
+		return c.Render(http.StatusOK, "error.html", err.Error())
+	}
+	return c.Redirect(http.StatusTemporaryRedirect, "/#status")
+}
+
+/*
+ * AJAX: return the ranking of the exits in the scope.  Use `?switch=1`
+ * to also switch to the best one.
+ */
+func rank(c echo.Context) error {
+	vendor := pathParam(c, "vendor")
+	if len(c.QueryParam("switch")) == 0 {
+		result, err := rankExits(vendor, scopeParam(c))
+		if err != nil {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		return c.JSONPretty(http.StatusOK, result, " ")
+	}
+
+	var result *AutoSelectResult
+	_, err := requestSwitch(c, func() (string, error) {
+		var err error
+		result, err = autoSelect(vendor, scopeParam(c))
+		if result == nil {
+			return "", err
+		}
+		return result.Selected, err
+	})
+	if result == nil {
+		return c.String(http.StatusNotFound, err.Error())
+	} else if err != nil {
+		// ranked, but none of the candidates came up
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSONPretty(http.StatusOK, result, " ")
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+/*
+ * The resolved vendors are saved to `catalog_file` after every refresh so
+ * we can start with them (marked stale) instead of waiting for DNS.  Each
+ * vendor is stored with a hash of its config block and is thrown away if
+ * the block in config.yaml changes.
+ */
+type Catalog struct {
+	Refreshed time.Time
+	Hashes    map[string]string
+	Vendors   map[string]*VendorConfig
+}
+
+func vendorHash(vendor string) string {
+	data, _ := json.Marshal(Konf.Cut(vendor).Raw())
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+ * Returns the vendors in the catalog_file which are still current
+ */
+func loadCatalog() (map[string]*VendorConfig, time.Time) {
+	fname := Konf.String("catalog_file")
+	if len(fname) == 0 || !fileExists(fname) {
+		return nil, time.Time{}
+	}
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		log.Printf("Unable to read catalog_file %s: %s", fname, err.Error())
+		return nil, time.Time{}
+	}
+	catalog := Catalog{}
+	if err = json.Unmarshal(data, &catalog); err != nil {
+		log.Printf("Unable to parse catalog_file %s: %s", fname, err.Error())
+		return nil, time.Time{}
+	}
+
+	vendors := map[string]*VendorConfig{}
+	for _, vendor := range Konf.Strings("vendors") {
+		vc, ok := catalog.Vendors[vendor]
+		if !ok || vc == nil {
+			continue
+		}
+		if catalog.Hashes[vendor] != vendorHash(vendor) {
+			log.Printf("Config for %s has changed, ignoring it in the catalog_file", vendor)
+			continue
+		}
+		vc.Servers.setParents(nil)
+		vendors[vendor] = vc
+	}
+	if len(vendors) == 0 {
+		return nil, time.Time{}
+	}
+	return vendors, catalog.Refreshed
+}
+
+func saveCatalog(vendors map[string]*VendorConfig, refreshed time.Time) {
+	fname := Konf.String("catalog_file")
+	if len(fname) == 0 {
+		return
+	}
+	catalog := Catalog{
+		Refreshed: refreshed,
+		Hashes:    map[string]string{},
+		Vendors:   vendors,
+	}
+	for vendor := range vendors {
+		catalog.Hashes[vendor] = vendorHash(vendor)
+	}
+	data, err := json.Marshal(&catalog)
+	if err != nil {
+		log.Printf("Unable to save catalog: %s", err.Error())
+		return
+	}
+	// write & rename so we never leave a truncated file behind
+	tmp := fname + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("Unable to write catalog_file %s: %s", tmp, err.Error())
+		return
+	}
+	if err = os.Rename(tmp, fname); err != nil {
+		log.Printf("Unable to write catalog_file %s: %s", fname, err.Error())
+	}
+}
+
+/*
+ * Parent isn't saved in the catalog, so restore it
+ */
+func (sm *ServerMap) setParents(parent *ServerMap) {
+	sm.Parent = parent
+	for _, child := range sm.getMap() {
+		child.setParents(sm)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/synfinatic/vpnexiter/vpn"
+)
+
+/*
+ * A multi-hop chain from the `chains` config which can be selected like
+ * any other exit.  The first hop is the outer tunnel and our traffic
+ * exits from the last one, so GS.Vendor, GS.Exit & GS.ExitPath are
+ * always the last hop.
+ */
+type Chain struct {
+	Name string
+	Hops []ExitSpec
+}
+
+// A hop we are (or will be) on
+type ChainHop struct {
+	Vendor string
+	Exit   string
+	Path   []string
+}
+
+func (ch Chain) String() string {
+	hops := []string{}
+	for _, hop := range ch.Hops {
+		hops = append(hops, hop.String())
+	}
+	return strings.Join(hops, " » ")
+}
+
+func chains() []Chain {
+	chains := []Chain{}
+	for _, k := range Konf.Slices("chains") {
+		ch := Chain{
+			Name: k.String("name"),
+			Hops: []ExitSpec{},
+		}
+		for _, hop := range k.Slices("hops") {
+			ch.Hops = append(ch.Hops, newExitSpec(hop))
+		}
+		chains = append(chains, ch)
+	}
+	return chains
+}
+
+func getChain(name string) (Chain, error) {
+	for _, ch := range chains() {
+		if ch.Name == name {
+			return ch, nil
+		}
+	}
+	return Chain{}, fmt.Errorf("Unknown chain: %s", name)
+}
+
+/*
+ * Finds the path of each hop's exit
+ */
+func (ch Chain) resolve() ([]ChainHop, error) {
+	if len(ch.Hops) < 2 {
+		return nil, fmt.Errorf("Chain %s needs at least two hops", ch.Name)
+	}
+	hops := []ChainHop{}
+	for _, spec := range ch.Hops {
+		if len(spec.Exit) == 0 {
+			return nil, fmt.Errorf("Chain %s: every hop needs an exit", ch.Name)
+		}
+		vc, err := getVendorConfig(spec.Vendor)
+		if err != nil {
+			return nil, err
+		}
+		path, err := findExit(&vc.Servers, spec.path())
+		if err != nil {
+			return nil, err
+		}
+		hops = append(hops, ChainHop{Vendor: spec.Vendor, Exit: spec.Exit, Path: path})
+	}
+	return hops, nil
+}
+
+func vpnHops(hops []ChainHop) []vpn.Hop {
+	ret := []vpn.Hop{}
+	for _, hop := range hops {
+		ret = append(ret, vpn.Hop{Vendor: hop.Vendor, Exit: hop.Exit, Info: exitInfo(hop.Vendor, hop.Path)})
+	}
+	return ret
+}
+
+/*
+ * Switch to the named chain using the SwitchPolicy retries.  There are
+ * no fallbacks, since each hop is an explicit server.
+ */
+func switchChain(name string) (string, error) {
+	switchMux.Lock()
+	defer switchMux.Unlock()
+
+	ch, err := getChain(name)
+	if err != nil {
+		return "", err
+	}
+	hops, err := ch.resolve()
+	if err != nil {
+		return "", err
+	}
+	err = retrySwitch(getSwitchPolicy(), ch.String(), func() error {
+		return trySwitchChain(name, hops)
+	})
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Switched to chain %s: %s", name, ch.String())
+	return hops[len(hops)-1].Exit, nil
+}
+
+// for the status page: every hop we are on
+func (gs GlobalState) ChainPath() string {
+	if len(gs.Hops) == 0 {
+		return strings.Join(gs.ExitPath, " / ")
+	}
+	hops := []string{}
+	for _, hop := range gs.Hops {
+		hops = append(hops, strings.Join(append([]string{hop.Vendor}, hop.Path...), " / "))
+	}
+	return strings.Join(hops, " » ")
+}
+
+/*
+ * UI: switch to the named chain
+ */
+func SelectChain(c echo.Context) error {
+	name := pathParam(c, "name")
+	_, err := requestSwitch(c, func() (string, error) {
+		return switchChain(name)
+	})
+	if err != nil {
+		return c.Render(http.StatusOK, "error.html", err.Error())
+	}
+	return c.Redirect(http.StatusTemporaryRedirect, "/#status")
+}
+
+/*
+ * AJAX: the configured chains
+ */
+func chainList(c echo.Context) error {
+	return c.JSONPretty(http.StatusOK, chains(), " ")
+}
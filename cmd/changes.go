@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+/*
+ * Every refresh of GS.Vendors is compared with the previous one and the
+ * servers which were added, removed or now resolve to other IPs are
+ * logged & kept (the last `server_changes.history`) for the UI & API.
+ */
+const (
+	ServerAdded   = "added"
+	ServerRemoved = "removed"
+	ServerChanged = "changed"
+)
+
+type ServerChange struct {
+	Time   time.Time
+	Vendor string
+	Path   []string // location & server
+	ID     string   // exit ID
+	Kind   string
+	OldIPs []string `json:",omitempty"`
+	NewIPs []string `json:",omitempty"`
+}
+
+func (sc ServerChange) String() string {
+	s := fmt.Sprintf("%s %s / %s", sc.Kind, sc.Vendor, strings.Join(sc.Path, " / "))
+	switch sc.Kind {
+	case ServerChanged:
+		s += fmt.Sprintf(": %s -> %s", strings.Join(sc.OldIPs, ", "), strings.Join(sc.NewIPs, ", "))
+	case ServerAdded:
+		if len(sc.NewIPs) > 0 {
+			s += fmt.Sprintf(": %s", strings.Join(sc.NewIPs, ", "))
+		}
+	}
+	return s
+}
+
+type ServerChanges struct {
+	History int
+	Changes []ServerChange // oldest first
+	mux     sync.Mutex
+}
+
+func NewServerChanges() *ServerChanges {
+	sc := ServerChanges{History: 100}
+	if Konf.Int("server_changes.history") > 0 {
+		sc.History = Konf.Int("server_changes.history")
+	}
+	return &sc
+}
+
+func (sc *ServerChanges) add(changes []ServerChange) {
+	sc.mux.Lock()
+	defer sc.mux.Unlock()
+	sc.Changes = append(sc.Changes, changes...)
+	if len(sc.Changes) > sc.History {
+		sc.Changes = sc.Changes[len(sc.Changes)-sc.History:]
+	}
+}
+
+/*
+ * The last count changes for vendor (or every vendor if empty), newest first
+ */
+func (sc *ServerChanges) Recent(vendor string, count int) []ServerChange {
+	sc.mux.Lock()
+	defer sc.mux.Unlock()
+	ret := []ServerChange{}
+	for i := len(sc.Changes) - 1; i >= 0 && (count <= 0 || len(ret) < count); i-- {
+		if vendor == "" || sc.Changes[i].Vendor == vendor {
+			ret = append(ret, sc.Changes[i])
+		}
+	}
+	return ret
+}
+
+type serverEntry struct {
+	Path []string
+	IPs  []string
+}
+
+/*
+ * Flattens the ServerMap into every server & its IPs, keyed by path
+ */
+func flattenServers(sm *ServerMap, path []string, entries map[string]serverEntry) {
+	add := func(server string, ips []string) {
+		p := append(append([]string{}, path...), server)
+		entries[strings.Join(p, "\x00")] = serverEntry{Path: p, IPs: ips}
+	}
+	for _, server := range sm.getList() {
+		ips := []string{}
+		if net.ParseIP(server) != nil {
+			ips = append(ips, server)
+		}
+		add(server, ips)
+	}
+	keys := []string{}
+	for key := range sm.getMap() {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		child := sm.getMap()[key]
+		if sm.isServer(key) {
+			// key is a resolved hostname => IPs
+			add(key, child.getList())
+		} else {
+			flattenServers(child, append(append([]string{}, path...), key), entries)
+		}
+	}
+}
+
+func sameIPs(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	// DNS round robin reorders the answers, so that isn't a change
+	x := append([]string{}, a...)
+	y := append([]string{}, b...)
+	sort.Strings(x)
+	sort.Strings(y)
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * Returns what changed between the old and new ServerMap of a vendor
+ */
+func diffServers(vendor string, old *ServerMap, new *ServerMap) []ServerChange {
+	now := time.Now()
+	before := map[string]serverEntry{}
+	after := map[string]serverEntry{}
+	flattenServers(old, []string{}, before)
+	flattenServers(new, []string{}, after)
+
+	keys := []string{}
+	for key := range before {
+		keys = append(keys, key)
+	}
+	for key := range after {
+		if _, ok := before[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	changes := []ServerChange{}
+	for _, key := range keys {
+		b, inBefore := before[key]
+		a, inAfter := after[key]
+		change := ServerChange{Time: now, Vendor: vendor}
+		switch {
+		case !inBefore:
+			change.Kind, change.Path, change.NewIPs = ServerAdded, a.Path, a.IPs
+		case !inAfter:
+			change.Kind, change.Path, change.OldIPs = ServerRemoved, b.Path, b.IPs
+		case !sameIPs(b.IPs, a.IPs):
+			change.Kind, change.Path, change.OldIPs, change.NewIPs = ServerChanged, a.Path, b.IPs, a.IPs
+		default:
+			continue
+		}
+		change.ID = exitID(vendor, change.Path)
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+/*
+ * Compares the refreshed vendors with the current GS.Vendors.  Vendors
+ * which weren't loaded before are skipped so startup isn't reported as
+ * every server being added.
+ */
+func recordServerChanges(old map[string]*VendorConfig, vendors map[string]*VendorConfig) {
+	if GS.ServerChanges == nil || old == nil {
+		return
+	}
+	changes := []ServerChange{}
+	for name, vc := range vendors {
+		prev, ok := old[name]
+		if !ok || prev == nil {
+			continue
+		}
+		changes = append(changes, diffServers(name, &prev.Servers, &vc.Servers)...)
+	}
+	for _, change := range changes {
+		log.Printf("Server change: %s", change.String())
+	}
+	GS.ServerChanges.add(changes)
+
+	if exitMissing(vendors, GS.Vendor, GS.Exit) {
+		log.Printf("Warning: current exit %s is no longer listed for %s", GS.Exit, GS.Vendor)
+	}
+}
+
+/*
+ * Is the exit we are connected to gone from the vendor's servers?
+ */
+func exitMissing(vendors map[string]*VendorConfig, vendor string, exit string) bool {
+	vc, ok := vendors[vendor]
+	if !ok || vc == nil || len(GS.ExitPath) == 0 {
+		// never selected an exit
+		return false
+	}
+	entries := map[string]serverEntry{}
+	flattenServers(&vc.Servers, []string{}, entries)
+	for _, entry := range entries {
+		if entry.Path[len(entry.Path)-1] == exit {
+			return false
+		}
+		for _, ip := range entry.IPs {
+			if ip == exit {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+/*
+ * Warning for the status page when GS.Exit is no longer listed
+ */
+func (gs GlobalState) ExitMissing() string {
+	if exitMissing(gs.Vendors, gs.Vendor, gs.Exit) {
+		return fmt.Sprintf("Exit %s is no longer listed for %s, pick another exit", gs.Exit, gs.Vendor)
+	}
+	return ""
+}
+
+/*
+ * AJAX: the recent server changes, optionally for ?vendor=
+ */
+func serverChanges(c echo.Context) error {
+	if GS.ServerChanges == nil {
+		return c.String(http.StatusNotFound, "Server changes are not tracked")
+	}
+	return c.JSONPretty(http.StatusOK, map[string]interface{}{
+		"Changes":     GS.ServerChanges.Recent(c.QueryParam("vendor"), 0),
+		"ExitMissing": GS.ExitMissing(),
+	}, " ")
+}
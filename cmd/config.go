@@ -42,6 +42,8 @@ func LoadConfig(cfile string) {
 		"router.host":    "192.168.1.1",
 		"router.port":    22,
 		"router.user":    "admin",
+		"state_file":     "vpnexiter-state.json",
+		"catalog_file":   "vpnexiter-catalog.json",
 	}, "."), nil)
 
 	if len(cfile) > 0 {
@@ -101,38 +103,34 @@ func Levels(vendor string) []string {
 }
 
 func GetServers(vendor string, path []string) ([]string, error) {
-	fullpath, err := GetPath(vendor, path)
+	level, err := configLevel(vendor, path)
 	if err != nil {
-		log.Printf("GetServers: %s / %s", vendor, fullpath)
+		log.Printf("GetServers: %s", err.Error())
 		return nil, err
-	} else {
-		return Konf.Strings(fullpath), nil
 	}
+	return level.Servers, nil
 }
 
 func GetPath(vendor string, path []string) (string, error) {
+	if _, err := configLevel(vendor, path); err != nil {
+		return "", err
+	}
 	fullpath := fmt.Sprintf("%s.servers", vendor)
 	if len(path) > 0 {
 		vars := strings.Join(path, ".")
 		fullpath = fmt.Sprintf("%s.%s", fullpath, vars)
 	}
-	if !Konf.Exists(fullpath) {
-		return "", fmt.Errorf("Invalid path: %s", fullpath)
-	}
 	return fullpath, nil
 }
 
+/*
+ * Returns the sub-levels of the path, which is empty for a location
+ */
 func GetPathKeys(vendor string, path []string) ([]string, error) {
-	fullpath, err := GetPath(vendor, path)
+	level, err := configLevel(vendor, path)
 	if err != nil {
-		log.Printf("GetPathKeys: %s / %s", vendor, fullpath)
+		log.Printf("GetPathKeys: %s", err.Error())
 		return nil, err
 	}
-	pdata := Konf.StringMap(fullpath)
-	log.Printf("fullpath %s", fullpath)
-	keys := make([]string, 0, len(pdata))
-	for k, _ := range pdata {
-		keys = append(keys, k)
-	}
-	return keys, nil
+	return level.keys(), nil
 }
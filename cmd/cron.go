@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Minimal cron(5) style schedule: "minute hour day-of-month month day-of-week"
+ * Each field supports `*`, `N`, `N-M`, `*\/S`, `N-M/S` and comma separated
+ * lists of those.  Day of week is 0-6 with 0 = Sunday (7 also works).
+ * Like cron, if both day fields are restricted either one may match.
+ */
+type CronSchedule struct {
+	Spec    string
+	minute  map[int]bool
+	hour    map[int]bool
+	dom     map[int]bool
+	month   map[int]bool
+	dow     map[int]bool
+	domStar bool
+	dowStar bool
+}
+
+func ParseCron(spec string) (*CronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Invalid cron spec `%s`: expected 5 fields", spec)
+	}
+	cs := &CronSchedule{Spec: spec}
+	var err error
+	bounds := []struct {
+		dst      *map[int]bool
+		min, max int
+	}{
+		{&cs.minute, 0, 59},
+		{&cs.hour, 0, 23},
+		{&cs.dom, 1, 31},
+		{&cs.month, 1, 12},
+		{&cs.dow, 0, 7},
+	}
+	for i, b := range bounds {
+		*b.dst, err = parseCronField(fields[i], b.min, b.max)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid cron spec `%s`: %s", spec, err.Error())
+		}
+	}
+	if cs.dow[7] {
+		cs.dow[0] = true
+	}
+	// `1-31` or `*/1` are as unrestricted as `*`
+	cs.domStar = coversRange(cs.dom, 1, 31)
+	cs.dowStar = coversRange(cs.dow, 0, 6)
+	return cs, nil
+}
+
+// true if every value from min to max is set
+func coversRange(vals map[int]bool, min int, max int) bool {
+	for v := min; v <= max; v++ {
+		if !vals[v] {
+			return false
+		}
+	}
+	return true
+}
+
+func parseCronField(field string, min int, max int) (map[int]bool, error) {
+	vals := map[int]bool{}
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s < 1 {
+				return nil, fmt.Errorf("bad step in `%s`", part)
+			}
+			step = s
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			r := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(r[0]); err != nil {
+				return nil, fmt.Errorf("bad value `%s`", part)
+			}
+			hi = lo
+			if len(r) == 2 {
+				if hi, err = strconv.Atoi(r[1]); err != nil {
+					return nil, fmt.Errorf("bad value `%s`", part)
+				}
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("`%s` out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			vals[v] = true
+		}
+	}
+	return vals, nil
+}
+
+// true if the schedule fires during the minute of t
+func (cs *CronSchedule) Matches(t time.Time) bool {
+	if !cs.minute[t.Minute()] || !cs.hour[t.Hour()] || !cs.month[int(t.Month())] {
+		return false
+	}
+	domMatch := cs.dom[t.Day()]
+	dowMatch := cs.dow[int(t.Weekday())]
+	if cs.domStar || cs.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+/*
+ * Returns the first time after t the schedule fires or the zero time
+ * if it doesn't fire within the next year
+ */
+func (cs *CronSchedule) Next(t time.Time) time.Time {
+	next := t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(1, 0, 1)
+	for next.Before(end) {
+		if !cs.month[int(next.Month())] {
+			next = time.Date(next.Year(), next.Month()+1, 1, 0, 0, 0, 0, next.Location())
+			continue
+		}
+		if !cs.Matches(next) && !cs.hour[next.Hour()] {
+			// Truncate() works in UTC, which is off by 30 minutes in some zones
+			hour := time.Date(next.Year(), next.Month(), next.Day(), next.Hour()+1, 0, 0, 0, next.Location())
+			if hour.After(next) {
+				next = hour
+			} else {
+				// the DST change repeated the hour
+				next = next.Add(time.Minute)
+			}
+			continue
+		}
+		if cs.Matches(next) {
+			return next
+		}
+		next = next.Add(time.Minute)
+	}
+	return time.Time{}
+}
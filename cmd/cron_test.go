@@ -0,0 +1,148 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		spec    string
+		valid   bool
+		domStar bool
+		dowStar bool
+	}{
+		{"* * * * *", true, true, true},
+		{"30 9 * * 1-5", true, true, false},
+		{"0 0 1 * *", true, false, true},
+		{"0 0 1-31 * 0-6", true, true, true},
+		{"0 0 */1 * 1-7", true, true, true},
+		{"0 0 1,15 * 0,6", true, false, false},
+		{"0 0 * * 7", true, true, false},
+		{"*/15 0-23/2 * 1-12/3 *", true, true, true},
+		{"* * * *", false, false, false},
+		{"60 * * * *", false, false, false},
+		{"* 24 * * *", false, false, false},
+		{"* * 0 * *", false, false, false},
+		{"* * * 13 *", false, false, false},
+		{"* * * * 8", false, false, false},
+		{"5-1 * * * *", false, false, false},
+		{"*/0 * * * *", false, false, false},
+		{"a * * * *", false, false, false},
+	}
+	for _, tt := range tests {
+		cs, err := ParseCron(tt.spec)
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.spec, err.Error())
+			continue
+		}
+		if cs.domStar != tt.domStar || cs.dowStar != tt.dowStar {
+			t.Errorf("%s: domStar = %v, dowStar = %v", tt.spec, cs.domStar, cs.dowStar)
+		}
+	}
+}
+
+func TestCronMatches(t *testing.T) {
+	// Friday the 13th
+	friday := time.Date(2026, 11, 13, 9, 30, 0, 0, time.UTC)
+	// Monday the 2nd
+	monday := time.Date(2026, 11, 2, 9, 30, 0, 0, time.UTC)
+	tests := []struct {
+		spec string
+		when time.Time
+		want bool
+	}{
+		{"30 9 * * *", friday, true},
+		{"31 9 * * *", friday, false},
+		{"30 9 * * 1-5", friday, true},
+		{"30 9 * * 0,6", friday, false},
+		{"30 9 13 * *", friday, true},
+		{"30 9 14 * *", friday, false},
+		// both day fields restricted: either one matches
+		{"30 9 13 * 1", friday, true},
+		{"30 9 13 * 1", monday, true},
+		{"30 9 14 * 3", friday, false},
+		// a day field covering its whole range is unrestricted
+		{"30 9 1-31 * 1", friday, false},
+		{"30 9 1-31 * 1", monday, true},
+		{"30 9 2 * 0-6", friday, false},
+		{"30 9 2 * 0-6", monday, true},
+		{"30 9 2 * 1-7", monday, true},
+		{"30 9 * 11 *", friday, true},
+		{"30 9 * 12 *", friday, false},
+	}
+	for _, tt := range tests {
+		cs, err := ParseCron(tt.spec)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.spec, err.Error())
+		}
+		if got := cs.Matches(tt.when); got != tt.want {
+			t.Errorf("%s at %s: got %v, want %v", tt.spec, tt.when.Format(time.RFC1123), got, tt.want)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// Saturday
+	base := time.Date(2026, 10, 17, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"30 9 * * 1-5", time.Date(2026, 10, 19, 9, 30, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, 10, 17, 10, 15, 0, 0, time.UTC)},
+		{"0 0 1 1 *", time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 1-31 * 0", time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)},
+		// never fires
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		cs, err := ParseCron(tt.spec)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.spec, err.Error())
+		}
+		if got := cs.Next(base); !got.Equal(tt.want) {
+			t.Errorf("%s: got %s, want %s", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestCronNextLocal(t *testing.T) {
+	tests := []struct {
+		zone string
+		spec string
+		base time.Time
+		want time.Time
+	}{
+		// UTC+5:30, so hours start at :30 in UTC
+		{"Asia/Kolkata", "0 9 * * *", time.Date(2026, 10, 17, 8, 10, 0, 0, time.UTC), time.Date(2026, 10, 17, 9, 0, 0, 0, time.UTC)},
+		{"Asia/Kolkata", "15 * * * *", time.Date(2026, 10, 17, 23, 50, 0, 0, time.UTC), time.Date(2026, 10, 18, 0, 15, 0, 0, time.UTC)},
+		// UTC+5:45
+		{"Asia/Kathmandu", "0 0 1 * *", time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC), time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)},
+		// DST starts at 02:00 and ends at 02:00 (back to 01:00)
+		{"America/New_York", "30 3 * * *", time.Date(2026, 3, 8, 0, 0, 0, 0, time.UTC), time.Date(2026, 3, 8, 3, 30, 0, 0, time.UTC)},
+		{"America/New_York", "30 2 * * *", time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 11, 1, 2, 30, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		loc, err := time.LoadLocation(tt.zone)
+		if err != nil {
+			t.Skipf("no zoneinfo for %s: %s", tt.zone, err.Error())
+		}
+		cs, err := ParseCron(tt.spec)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.spec, err.Error())
+		}
+		// base & want are wall clock times in the zone
+		base := time.Date(tt.base.Year(), tt.base.Month(), tt.base.Day(), tt.base.Hour(), tt.base.Minute(), 0, 0, loc)
+		want := time.Date(tt.want.Year(), tt.want.Month(), tt.want.Day(), tt.want.Hour(), tt.want.Minute(), 0, 0, loc)
+		if got := cs.Next(base); !got.Equal(want) {
+			t.Errorf("%s in %s: got %s, want %s", tt.spec, tt.zone, got, want)
+		}
+	}
+}
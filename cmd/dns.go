@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+/*
+ * Points the router's resolver at the DNS servers of the current exit so
+ * we don't leak queries to the ISP resolver while on the VPN.
+ *
+ * Servers come from the matching `<vendor>.exit_dns` entry (matched
+ * against the exit or any level of the ExitPath, deepest wins) or the
+ * vendor's `dns_servers`.  An exit without DNS servers gets an empty
+ * config, so the resolver falls back to its usual upstreams.
+ */
+type TunnelDNS struct {
+	Backend   string
+	Servers   []string
+	ExitPath  []string
+	LastError string
+	Applied   time.Time
+	mux       sync.Mutex
+}
+
+type DNSTemplate struct {
+	Servers    []string
+	ServerList string // space separated
+	Vendor     string
+	Exit       string
+	File       string
+}
+
+type dnsBackend struct {
+	Config string
+	File   string
+	Reload []string
+	Flush  []string
+}
+
+var dnsBackends = map[string]dnsBackend{
+	"dnsmasq": {
+		Config: `{{ if .Servers -}}
+no-resolv
+{{ range .Servers -}}
+server={{ . }}
+{{ end -}}
+{{ end -}}
+`,
+		File: "/etc/dnsmasq.d/vpnexiter-dns.conf",
+		// a restart also empties the cache
+		Reload: []string{"/etc/init.d/dnsmasq restart"},
+		Flush:  []string{},
+	},
+	"resolved": {
+		Config: `{{ if .Servers -}}
+[Resolve]
+DNS={{ .ServerList }}
+Domains=~.
+{{ end -}}
+`,
+		File:   "/etc/systemd/resolved.conf.d/vpnexiter.conf",
+		Reload: []string{"systemctl restart systemd-resolved"},
+		Flush:  []string{"resolvectl flush-caches"},
+	},
+	// bring your own `dns.template`, `dns.file` & commands
+	"template": {
+		Reload: []string{},
+		Flush:  []string{},
+	},
+}
+
+func NewTunnelDNS() *TunnelDNS {
+	td := &TunnelDNS{
+		Backend: Konf.String("dns.backend"),
+		Servers: []string{},
+	}
+	if len(td.Backend) == 0 {
+		td.Backend = "dnsmasq"
+	}
+	return td
+}
+
+/*
+ * The DNS servers for the exit
+ */
+func dnsServers(vendor string, exit string, path []string) []string {
+	levels := append(append([]string{}, path...), exit)
+	servers, depth := Konf.Strings(fmt.Sprintf("%s.dns_servers", vendor)), -1
+	for _, k := range Konf.Slices(fmt.Sprintf("%s.exit_dns", vendor)) {
+		for i, level := range levels {
+			if level == k.String("match") && i > depth {
+				servers, depth = k.Strings("servers"), i
+			}
+		}
+	}
+	valid := []string{}
+	for _, s := range servers {
+		if net.ParseIP(s) == nil {
+			log.Printf("Warning: invalid DNS server %s for %s", s, vendor)
+			continue
+		}
+		valid = append(valid, s)
+	}
+	return valid
+}
+
+func (td *TunnelDNS) backend() (dnsBackend, error) {
+	backend, ok := dnsBackends[td.Backend]
+	if !ok {
+		return backend, fmt.Errorf("Unknown dns.backend %s", td.Backend)
+	}
+	if fname := Konf.String("dns.template"); len(fname) > 0 {
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return backend, err
+		}
+		backend.Config = string(data)
+	}
+	if len(Konf.String("dns.file")) > 0 {
+		backend.File = Konf.String("dns.file")
+	}
+	if len(backend.Config) == 0 || len(backend.File) == 0 {
+		return backend, fmt.Errorf("dns.backend %s needs dns.template and dns.file", td.Backend)
+	}
+	return backend, nil
+}
+
+/*
+ * Deploys the resolver config for the exit, then reloads the resolver
+ * and flushes its cache.  Called after every successful switch.
+ */
+func (td *TunnelDNS) Apply(vendor string, exit string, path []string) error {
+	td.mux.Lock()
+	defer td.mux.Unlock()
+	err := td.apply(vendor, exit, path)
+	td.Applied = time.Now()
+	td.LastError = ""
+	if err != nil {
+		td.LastError = err.Error()
+		log.Printf("DNS: %s", td.LastError)
+	}
+	return err
+}
+
+func (td *TunnelDNS) apply(vendor string, exit string, path []string) error {
+	backend, err := td.backend()
+	if err != nil {
+		return err
+	}
+	servers := dnsServers(vendor, exit, path)
+	data := DNSTemplate{
+		Servers:    servers,
+		ServerList: strings.Join(servers, " "),
+		Vendor:     vendor,
+		Exit:       exit,
+		File:       backend.File,
+	}
+	if err = GS.VPN.DeployTemplate("dns.template", backend.Config, data, backend.File); err != nil {
+		return err
+	}
+	// the old servers are no longer in use once the file is replaced
+	td.Servers, td.ExitPath = servers, append([]string{vendor}, path...)
+
+	reload := GS.VPN.CommandsOr("dns.reload_command", backend.Reload...)
+	if _, err = GS.VPN.RunTemplates("dns.reload_command", reload, data); err != nil {
+		return err
+	}
+	flush := GS.VPN.CommandsOr("dns.flush_command", backend.Flush...)
+	if _, err = GS.VPN.RunTemplates("dns.flush_command", flush, data); err != nil {
+		return err
+	}
+	if len(servers) > 0 {
+		log.Printf("DNS: using %s for %s", data.ServerList, exit)
+	} else {
+		log.Printf("DNS: no servers configured for %s, using the default resolvers", exit)
+	}
+	return nil
+}
+
+/*
+ * true if the servers were applied for the current exit
+ */
+func (td *TunnelDNS) Current() bool {
+	return strings.Join(td.ExitPath, "/") == strings.Join(GS.ExitPath, "/")
+}
+
+/*
+ * Sends a query directly to each of the DNS servers.  Used by the
+ * post-switch verification, so the servers are queried through the tunnel.
+ */
+func (td *TunnelDNS) check() []string {
+	problems := []string{}
+	if len(td.LastError) > 0 {
+		problems = append(problems, fmt.Sprintf("Unable to configure the DNS servers: %s", td.LastError))
+	}
+	if !td.Current() {
+		return append(problems, fmt.Sprintf("DNS servers are for %s, not the current exit", strings.Join(td.ExitPath, " / ")))
+	}
+	hostname := Konf.String("dns.check_hostname")
+	if len(hostname) == 0 {
+		hostname = "example.com"
+	}
+	for _, server := range td.Servers {
+		addr := net.JoinHostPort(server, "53")
+		resolver := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				d := net.Dialer{}
+				return d.DialContext(ctx, network, addr)
+			},
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), verifyTimeout())
+		_, err := resolver.LookupHost(ctx, hostname)
+		cancel()
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("DNS server %s is not answering: %s", server, err.Error()))
+		}
+	}
+	return problems
+}
+
+/*
+ * AJAX: the DNS servers in use
+ */
+func dnsStatus(c echo.Context) error {
+	if GS.DNS == nil {
+		return c.String(http.StatusNotFound, "DNS management is not enabled")
+	}
+	return c.JSONPretty(http.StatusOK, GS.DNS, " ")
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+/*
+ * Level & server names are free form: "St. Louis", "A/B", "C++", "Zürich"
+ * all have to survive the config, the ServerMap, URLs and the templates.
+ *
+ * Konf uses `.` as the delimiter, so names are never joined into a koanf
+ * key.  configValue() walks the parsed config one name at a time instead.
+ *
+ * Names in URLs are escaped one path segment at a time via escapePath()
+ * and unescaped by pathParam() & scopeParam().
+ */
+
+/*
+ * Returns the config value at path, where each element is a single map
+ * key which may contain dots
+ */
+func configValue(path ...string) (interface{}, bool) {
+	var value interface{} = Konf.Raw()
+	for _, key := range path {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+/*
+ * Joins the names into an URL path, escaping each of them
+ */
+func escapePath(parts ...string) string {
+	escaped := make([]string, len(parts))
+	for i, part := range parts {
+		escaped[i] = url.PathEscape(part)
+	}
+	return strings.Join(escaped, "/")
+}
+
+/*
+ * Echo only matches on the escaped path (and so leaves the params escaped)
+ * when it differs from the default encoding, ie: the name has a `/`
+ */
+func unescapeParam(c echo.Context, value string) string {
+	if len(c.Request().URL.RawPath) == 0 {
+		return value
+	}
+	if unescaped, err := url.PathUnescape(value); err == nil {
+		return unescaped
+	}
+	return value
+}
+
+/*
+ * A single name from the URL, ie: `:vendor`
+ */
+func pathParam(c echo.Context, name string) string {
+	return unescapeParam(c, c.Param(name))
+}
+
+/*
+ * The names in the wildcard of `/auto_select/:vendor/*`, `/level/:vendor/*`,
+ * etc.  Split before unescaping so names can have a `/`.
+ */
+func scopeParam(c echo.Context) []string {
+	wildcard := strings.Trim(c.Param("*"), "/")
+	if len(wildcard) == 0 {
+		return []string{}
+	}
+	path := []string{}
+	for _, key := range strings.Split(wildcard, "/") {
+		path = append(path, unescapeParam(c, key))
+	}
+	return path
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+)
+
+/*
+ * An exit ID names a server by its vendor & path in the ServerMap:
+ * `<vendor>/<level>/.../<server>` with each name escaped by escapePath().
+ * Unlike the server name it is unique when a hostname or IP is listed in
+ * more than one location, stays the same across restarts & refreshes and
+ * is also the URL path under `/select_exit/`.
+ *
+ * Everything which only has a server name (old `/select_exit/<vendor>/<exit>`
+ * URLs, `exit:` in the config, `<vendor>/<exit>` client targets) falls back
+ * to looking the name up via findServer().
+ */
+func exitID(vendor string, path []string) string {
+	return escapePath(append([]string{vendor}, path...)...)
+}
+
+/*
+ * Returns the vendor & path of the exit ID
+ */
+func parseExitID(id string) (string, []string, error) {
+	parts := strings.Split(strings.Trim(id, "/"), "/")
+	for i, part := range parts {
+		name, err := url.PathUnescape(part)
+		if err != nil {
+			return "", nil, fmt.Errorf("Invalid exit ID %s: %s", id, err.Error())
+		}
+		parts[i] = name
+	}
+	if len(parts[0]) == 0 {
+		return "", nil, fmt.Errorf("Invalid exit ID %s: no vendor", id)
+	}
+	return parts[0], parts[1:], nil
+}
+
+/*
+ * Older state files stored the path joined by `/` without escaping.  An ID
+ * which doesn't survive a round trip through parseExitID() is one of those
+ * and is re-escaped.  Names containing a `/` can't be recovered.
+ */
+func migrateExitID(id string) string {
+	vendor, path, err := parseExitID(id)
+	if err == nil && exitID(vendor, path) == id {
+		return id
+	}
+	return escapePath(strings.Split(id, "/")...)
+}
+
+// for the status page & API
+func (gs GlobalState) ExitID() string {
+	if len(gs.ExitPath) == 0 {
+		return ""
+	}
+	return escapePath(gs.ExitPath...)
+}
+
+/*
+ * Is there a server at exactly this path?
+ */
+func (sm *ServerMap) hasServerPath(path []string) bool {
+	if len(path) == 0 {
+		return false
+	}
+	parent, err := sm.getNode(path[:len(path)-1])
+	if err != nil {
+		return false
+	}
+	server := path[len(path)-1]
+	if _, ok := parent.Unavailable[server]; ok || parent.isServer(server) {
+		return true
+	}
+	for _, s := range parent.getList() {
+		if s == server {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Returns the full path of the exit.  path is the exit ID path of the
+ * server, but if nothing is there (ie: just the name of the server) we
+ * look for the server below the levels of the path & then everywhere.
+ */
+func findExit(sm *ServerMap, path []string) ([]string, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("No exit given")
+	}
+	if sm.hasServerPath(path) {
+		return path, nil
+	}
+	levels, server := path[:len(path)-1], path[len(path)-1]
+	if node, err := sm.getNode(levels); err == nil && len(levels) > 0 {
+		if found, err := findServer(node, server); err == nil {
+			return append(append([]string{}, levels...), found...), nil
+		}
+	}
+	found, err := findServer(sm, server)
+	if err != nil {
+		return nil, err
+	}
+	if len(path) > 1 {
+		log.Printf("Exit %s is no longer listed, using %s", strings.Join(path, " / "), strings.Join(found, " / "))
+	}
+	return found, nil
+}
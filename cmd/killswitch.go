@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+/*
+ * Tracks the kill switch on the router.  The rules are only lifted
+ * during a controlled switch (when `kill_switch.lift_during_switch` is
+ * set), when the health monitor fails open or when an admin explicitly
+ * allows traffic to bypass the VPN.
+ */
+type KillSwitch struct {
+	Subnets   []string
+	Engaged   bool
+	Reason    string // why the kill switch is lifted
+	LastError string
+	Changed   time.Time
+	mux       sync.Mutex
+}
+
+const (
+	liftSwitching = "switching exits"
+	liftFailOpen  = "health monitor fail open"
+	liftAdmin     = "lifted by admin"
+)
+
+func NewKillSwitch() *KillSwitch {
+	return &KillSwitch{
+		Subnets: Konf.Strings("kill_switch.subnets"),
+	}
+}
+
+/*
+ * Engages the kill switch at startup, unless an admin lifted it before
+ * we exited
+ */
+func (ks *KillSwitch) Start() error {
+	psMux.Lock()
+	lifted := PS.KillSwitchLifted
+	psMux.Unlock()
+	if lifted {
+		log.Printf("Kill switch stays lifted: %s", liftAdmin)
+		return ks.Lift(liftAdmin)
+	}
+	return ks.Engage()
+}
+
+func (ks *KillSwitch) set(engage bool, reason string) error {
+	ks.mux.Lock()
+	defer ks.mux.Unlock()
+	return ks.setLocked(engage, reason)
+}
+
+// call with ks.mux held
+func (ks *KillSwitch) setLocked(engage bool, reason string) error {
+	if err := GS.VPN.SetKillSwitch(engage); err != nil {
+		ks.LastError = err.Error()
+		log.Printf("Kill switch: %s", ks.LastError)
+		return err
+	}
+	ks.Engaged = engage
+	ks.Reason = reason
+	ks.LastError = ""
+	ks.Changed = time.Now()
+	if engage {
+		log.Printf("Kill switch engaged for %s", strings.Join(ks.Subnets, ", "))
+	} else {
+		log.Printf("Kill switch lifted: %s", reason)
+	}
+
+	// an admin's fail open survives a restart
+	lifted := !engage && reason == liftAdmin
+	psMux.Lock()
+	changed := PS.KillSwitchLifted != lifted
+	PS.KillSwitchLifted = lifted
+	psMux.Unlock()
+	if changed {
+		saveState()
+	}
+	return nil
+}
+
+func (ks *KillSwitch) isEngaged() bool {
+	ks.mux.Lock()
+	defer ks.mux.Unlock()
+	return ks.Engaged
+}
+
+func (ks *KillSwitch) Engage() error {
+	return ks.set(true, "")
+}
+
+func (ks *KillSwitch) Lift(reason string) error {
+	return ks.set(false, reason)
+}
+
+/*
+ * Engage the kill switch, but only if it was lifted for one of the
+ * reasons.  Keeps us from undoing an admin's explicit fail open.
+ */
+func (ks *KillSwitch) restore(reasons ...string) {
+	ks.mux.Lock()
+	defer ks.mux.Unlock()
+	if ks.Engaged {
+		return
+	}
+	for _, reason := range reasons {
+		if ks.Reason == reason {
+			ks.setLocked(true, "")
+			return
+		}
+	}
+}
+
+/*
+ * Lifts the kill switch for a controlled switch if configured to.
+ * Call the returned func when the switch is done.
+ */
+func liftForSwitch() func() {
+	ks := GS.KillSwitch
+	if ks == nil || !ks.isEngaged() || !Konf.Bool("kill_switch.lift_during_switch") {
+		return func() {}
+	}
+	if err := ks.Lift(liftSwitching); err != nil {
+		return func() {}
+	}
+	return func() { ks.restore(liftSwitching) }
+}
+
+/*
+ * UI: POST /kill_switch/engage or /kill_switch/lift
+ */
+func KillSwitchAction(c echo.Context) error {
+	if GS.KillSwitch == nil {
+		return c.Render(http.StatusOK, "error.html", "Kill switch is not enabled")
+	}
+	var err error
+	switch c.Param("action") {
+	case "engage":
+		err = GS.KillSwitch.Engage()
+	case "lift":
+		err = GS.KillSwitch.Lift(liftAdmin)
+	default:
+		err = fmt.Errorf("Invalid action: %s", c.Param("action"))
+	}
+	if err != nil {
+		return c.Render(http.StatusOK, "error.html", err.Error())
+	}
+	return c.Redirect(http.StatusSeeOther, "/#status")
+}
+
+/*
+ * AJAX: kill switch state
+ */
+func killSwitch(c echo.Context) error {
+	if GS.KillSwitch == nil {
+		return c.String(http.StatusNotFound, "Kill switch is not enabled")
+	}
+	return c.JSONPretty(http.StatusOK, GS.KillSwitch, " ")
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/*
+ * Measures RTT & loss from this host to a VPN server.
+ *
+ * Method is `tcp` (time to connect or be refused, works unprivileged) or
+ * `icmp` (echo request, uses an unprivileged ICMP socket if we can't open
+ * a raw socket)
+ */
+type LatencyProbe struct {
+	Method   string
+	Port     int
+	Count    int
+	Timeout  time.Duration
+	Interval time.Duration
+}
+
+type LatencyResult struct {
+	IP   string
+	Sent int
+	RTTs []time.Duration
+}
+
+/*
+ * Reads the probe settings from the `<prefix>` config block
+ */
+func getLatencyProbe(prefix string) LatencyProbe {
+	lp := LatencyProbe{
+		Method:   "tcp",
+		Port:     443,
+		Count:    3,
+		Timeout:  time.Second,
+		Interval: 100 * time.Millisecond,
+	}
+	switch m := Konf.String(prefix + ".method"); m {
+	case "":
+	case "tcp", "icmp":
+		lp.Method = m
+	default:
+		log.Printf("Warning: unknown `%s.method` %s, using %s", prefix, m, lp.Method)
+	}
+	if Konf.Int(prefix+".port") > 0 {
+		lp.Port = Konf.Int(prefix + ".port")
+	}
+	if Konf.Int(prefix+".count") > 0 {
+		lp.Count = Konf.Int(prefix + ".count")
+	}
+	if Konf.Int(prefix+".timeout_ms") > 0 {
+		lp.Timeout = time.Duration(Konf.Int(prefix+".timeout_ms")) * time.Millisecond
+	}
+	return lp
+}
+
+func (lr LatencyResult) Recv() int {
+	return len(lr.RTTs)
+}
+
+// percent of probes which got no reply
+func (lr LatencyResult) Loss() float64 {
+	if lr.Sent == 0 {
+		return 100.0
+	}
+	return float64(lr.Sent-lr.Recv()) * 100.0 / float64(lr.Sent)
+}
+
+func (lr LatencyResult) AvgMs() float64 {
+	if lr.Recv() == 0 {
+		return 0.0
+	}
+	var total time.Duration
+	for _, rtt := range lr.RTTs {
+		total += rtt
+	}
+	return float64(total.Microseconds()) / float64(lr.Recv()) / 1000.0
+}
+
+// mean difference between consecutive RTTs
+func (lr LatencyResult) JitterMs() float64 {
+	if lr.Recv() < 2 {
+		return 0.0
+	}
+	var total time.Duration
+	for i := 1; i < lr.Recv(); i++ {
+		diff := lr.RTTs[i] - lr.RTTs[i-1]
+		if diff < 0 {
+			diff = -diff
+		}
+		total += diff
+	}
+	return float64(total.Microseconds()) / float64(lr.Recv()-1) / 1000.0
+}
+
+func (lp LatencyProbe) Measure(ip string) LatencyResult {
+	lr := LatencyResult{IP: ip, RTTs: []time.Duration{}}
+	for seq := 0; seq < lp.Count; seq++ {
+		if seq > 0 {
+			time.Sleep(lp.Interval)
+		}
+		lr.Sent++
+		var rtt time.Duration
+		var err error
+		if lp.Method == "icmp" {
+			rtt, err = icmpPing(ip, seq, lp.Timeout)
+		} else {
+			rtt, err = tcpPing(ip, lp.Port, lp.Timeout)
+		}
+		if err == nil {
+			lr.RTTs = append(lr.RTTs, rtt)
+		}
+	}
+	return lr
+}
+
+/*
+ * Measures all the IPs with at most concurrency probes in flight
+ */
+func (lp LatencyProbe) MeasureAll(ips []string, concurrency int) map[string]LatencyResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := map[string]LatencyResult{}
+	var mux sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for _, ip := range ips {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(ip string) {
+			defer wg.Done()
+			lr := lp.Measure(ip)
+			mux.Lock()
+			results[ip] = lr
+			mux.Unlock()
+			<-sem
+		}(ip)
+	}
+	wg.Wait()
+	return results
+}
+
+/*
+ * A refused connection still tells us the RTT, so only a timeout
+ * counts as loss
+ */
+func tcpPing(ip string, port int, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, strconv.Itoa(port)), timeout)
+	rtt := time.Since(start)
+	if err == nil {
+		conn.Close()
+		return rtt, nil
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return rtt, nil
+	}
+	return 0, err
+}
+
+func icmpPing(ip string, seq int, timeout time.Duration) (time.Duration, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return 0, errors.New("invalid IP address: " + ip)
+	}
+	network, unpriv, proto := "ip4:icmp", "udp4", 1
+	var echoType, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	if addr.To4() == nil {
+		network, unpriv, proto = "ip6:ipv6-icmp", "udp6", 58
+		echoType, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+
+	var dst net.Addr = &net.IPAddr{IP: addr}
+	conn, err := icmp.ListenPacket(network, "")
+	if err != nil {
+		// not root, so try an unprivileged ICMP socket
+		conn, err = icmp.ListenPacket(unpriv, "")
+		if err != nil {
+			return 0, err
+		}
+		dst = &net.UDPAddr{IP: addr}
+	}
+	defer conn.Close()
+
+	msg := icmp.Message{
+		Type: echoType,
+		Body: &icmp.Echo{ID: os.Getpid() & 0xffff, Seq: seq, Data: []byte("vpnexiter")},
+	}
+	pkt, err := msg.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(timeout))
+	if _, err = conn.WriteTo(pkt, dst); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			return 0, err
+		}
+		if !peerIs(peer, addr) {
+			// raw sockets see every reply, not just ours
+			continue
+		}
+		reply, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || reply.Type != replyType {
+			continue
+		}
+		// unprivileged sockets rewrite the ID, so only check the Seq
+		if echo, ok := reply.Body.(*icmp.Echo); ok && echo.Seq == seq {
+			return time.Since(start), nil
+		}
+	}
+}
+
+func peerIs(peer net.Addr, ip net.IP) bool {
+	switch p := peer.(type) {
+	case *net.IPAddr:
+		return p.IP.Equal(ip)
+	case *net.UDPAddr:
+		return p.IP.Equal(ip)
+	}
+	return false
+}
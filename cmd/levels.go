@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/synfinatic/vpnexiter/vpn"
+)
+
+/*
+ * A level of a vendor's `servers` config.  A level can list servers, have
+ * sub-levels or both (ie: a list with some maps in it) and sibling levels
+ * don't need to be the same depth, so `levels` only names them.
+ *
+ * A server is a hostname/IP or a map with a `host` (see readServerInfo()),
+ * so a map with a `host` is never a sub-level.  Servers only has the
+ * hosts, Info has the metadata of the servers given as a map.
+ *
+ * This is the one place we walk the config: buildServerMap(), walkLevels()
+ * GetPathKeys(), etc all work on it.
+ */
+type ServerLevel struct {
+	Servers []string
+	Levels  map[string]*ServerLevel
+	Info    map[string]vpn.ServerInfo
+}
+
+func newServerLevel() *ServerLevel {
+	return &ServerLevel{
+		Servers: []string{},
+		Levels:  map[string]*ServerLevel{},
+		Info:    map[string]vpn.ServerInfo{},
+	}
+}
+
+/*
+ * Parses the raw config value of a level
+ */
+func readServerLevel(value interface{}) *ServerLevel {
+	level := newServerLevel()
+	level.read(value)
+	return level
+}
+
+func (sl *ServerLevel) read(value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if info, ok := readServerInfo(v); ok {
+			sl.Servers = append(sl.Servers, info.Host)
+			sl.Info[info.Host] = info
+			return
+		}
+		for key, child := range v {
+			if existing, ok := sl.Levels[key]; ok {
+				existing.read(child)
+			} else {
+				sl.Levels[key] = readServerLevel(child)
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			sl.read(item)
+		}
+	case []string:
+		sl.Servers = append(sl.Servers, v...)
+	case nil:
+	default:
+		// a server, possibly parsed as a number
+		sl.Servers = append(sl.Servers, fmt.Sprint(v))
+	}
+}
+
+/*
+ * Returns the level at path below `<vendor>.servers`
+ */
+func configLevel(vendor string, path []string) (*ServerLevel, error) {
+	servers, ok := configValue(vendor, "servers")
+	if !ok {
+		return nil, fmt.Errorf("Unknown vendor: %s", vendor)
+	}
+	level := readServerLevel(servers)
+	for i, key := range path {
+		next, ok := level.Levels[key]
+		if !ok {
+			return nil, fmt.Errorf("Invalid path: %s / %s", vendor, strings.Join(path[:i+1], " / "))
+		}
+		level = next
+	}
+	return level, nil
+}
+
+/*
+ * Sorted names of the sub-levels
+ */
+func (sl *ServerLevel) keys() []string {
+	keys := []string{}
+	for key := range sl.Levels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/*
+ * Calls fn for the level & every level below it, parents first
+ */
+func (sl *ServerLevel) walk(path []string, fn func([]string, *ServerLevel)) {
+	fn(path, sl)
+	for _, key := range sl.keys() {
+		sl.Levels[key].walk(append(append([]string{}, path...), key), fn)
+	}
+}
+
+/*
+ * Every server at or below the level
+ */
+func (sl *ServerLevel) allServers() []string {
+	servers := []string{}
+	sl.walk([]string{}, func(_ []string, level *ServerLevel) {
+		servers = append(servers, level.Servers...)
+	})
+	return servers
+}
@@ -7,7 +7,9 @@ import (
 	"html/template"
 	"io"
 	"log"
+	"math/rand"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -19,14 +21,30 @@ import (
 )
 
 type GlobalState struct {
-	Connected    tribool.Tribool
-	ConnectedStr string
-	Vendor       string
-	Exit         string
-	ExitPath     []string
-	StatusOutput string
-	VPN          *vpn.VpnServer
-	Vendors      map[string]*VendorConfig
+	Connected        tribool.Tribool
+	ConnectedStr     string
+	Vendor           string
+	Exit             string
+	ExitPath         []string
+	ExitIPs          []string // addresses of Exit, in address_family order
+	StatusOutput     string
+	VPN              *vpn.VpnServer
+	Vendors          map[string]*VendorConfig
+	VendorsRefreshed time.Time // when GS.Vendors was last resolved
+	VendorsStale     bool      // GS.Vendors is from the catalog_file
+	SwitchedAt       time.Time
+	Monitor          *HealthMonitor
+	AutoSelect       *AutoSelectResult
+	Scheduler        *Scheduler
+	Rotation         *Rotation
+	Verification     *Verification
+	KillSwitch       *KillSwitch
+	PolicyRouting    *PolicyRouter
+	SplitTunnel      *SplitTunnel
+	DNS              *TunnelDNS
+	Chain            string     // name of the multi-hop chain we are on
+	Hops             []ChainHop // every hop we are on, outer first
+	ServerChanges    *ServerChanges
 }
 
 var GS = GlobalState{
@@ -38,6 +56,7 @@ var GS = GlobalState{
 	StatusOutput: "",
 	VPN:          nil,
 	Vendors:      nil,
+	Monitor:      nil,
 }
 
 func (gs *GlobalState) SetState(state tribool.Tribool) {
@@ -69,10 +88,14 @@ func Index(c echo.Context) error {
 	type SpeedTestTypes struct {
 		HasLocalSpeedtest   bool
 		HasEmbededSpeedtest bool
+		HasPolicyRouting    bool
+		HasSplitTunnel      bool
 	}
 	stt := SpeedTestTypes{
 		HasLocalSpeedtest:   len(Konf.String("speedtest_cli")) > 0,
 		HasEmbededSpeedtest: len(Konf.String("speedtest_url")) > 0,
+		HasPolicyRouting:    GS.PolicyRouting != nil,
+		HasSplitTunnel:      GS.SplitTunnel != nil,
 	}
 	return c.Render(http.StatusOK, "index.html", stt)
 }
@@ -115,49 +138,41 @@ func Status(c echo.Context) error {
 }
 
 func SelectExit(c echo.Context) error {
-	exit := c.Param("exit")
-	vendor := c.Param("vendor")
-	if exit == "" {
-		return c.Render(http.StatusOK, "select_exit.html", GS.Vendors)
-	} else {
-		err := GS.VPN.UpdateConfig(vendor, exit)
-		GS.Vendor = vendor
-		GS.Exit = exit
-		GS.SetState(tribool.False)
-		if err != nil {
-			return c.Render(http.StatusOK, "error.html", err.Error())
-		}
-
-		success, err := GS.VPN.Restart()
-		if err != nil {
-			return c.Render(http.StatusOK, "error.html", err.Error())
-		}
-
-		buf, err := GS.VPN.Status()
-		if err != nil {
-			log.Printf("Error getting Status()")
-			return c.Render(http.StatusOK, "error.html", err.Error())
-		}
-		GS.StatusOutput = buf.String()
+	vendor := pathParam(c, "vendor")
+	path := scopeParam(c)
+	if len(path) == 0 {
+		return c.Render(http.StatusOK, "select_exit.html", map[string]interface{}{
+			"Vendors":   GS.Vendors,
+			"Chains":    chains(),
+			"Refreshed": GS.VendorsRefreshed,
+			"Stale":     GS.VendorsStale,
+			"Changes":   GS.ServerChanges.Recent("", 10),
+			"Progress":  Loading.Summary(),
+		})
+	}
+	_, err := requestSwitch(c, func() (string, error) {
+		return switchExit(vendor, path)
+	})
+	if err != nil {
+		return c.Render(http.StatusOK, "error.html", err.Error())
+	}
+	return c.Redirect(http.StatusTemporaryRedirect, "/#status")
+}
 
-		log.Printf("Looking for exit '%s' in %v\n", exit, &GS.Vendors[vendor].Servers)
-		path, err := FindServerMapEntry(&GS.Vendors[vendor].Servers, exit)
-		if err != nil {
-			return c.Render(http.StatusOK, "error.html", err.Error())
-		}
-		GS.ExitPath = []string{vendor}
-		GS.ExitPath = append(GS.ExitPath, path...)
-
-		if success {
-			log.Printf("VPN restart was successful\n")
-			GS.SetState(tribool.True)
-			return c.Redirect(http.StatusTemporaryRedirect, "/#status")
-		} else {
-			log.Printf("VPN restart failed\n")
-			// return c.Render(http.StatusOK, "error.html", "VPN restart failed")
-			return c.Redirect(http.StatusTemporaryRedirect, "/#status")
-		}
+/*
+ * Switch to any server in the given location using the switch_policy
+ */
+func SelectLocation(c echo.Context) error {
+	vendor := pathParam(c, "vendor")
+	location := scopeParam(c)
+	exit, err := requestSwitch(c, func() (string, error) {
+		return switchLocation(vendor, location, "")
+	})
+	if err != nil {
+		return c.Render(http.StatusOK, "error.html", err.Error())
 	}
+	log.Printf("Selected %s in %s / %s", exit, vendor, strings.Join(location, " / "))
+	return c.Redirect(http.StatusTemporaryRedirect, "/#status")
 }
 
 func BasicAuthHandler(username string, password string, c echo.Context) (bool, error) {
@@ -190,37 +205,23 @@ func float64ToInt(val float64) int {
 	return (int)(val)
 }
 
-/*
- * Call in a goroutine because this blocks in a long sleep() loop
- * Allows us to asyncly load our GS.Vendors at startup and then
- * refresh our cache every X minutes
- */
-func loadVendors() {
-	GS.Vendors = LoadVendors()
-	if Konf.Exists("dns_refresh_minutes") {
-		if Konf.Int64("dns_refresh_minutes") >= 5 {
-			for true {
-				min := fmt.Sprintf("%dm", Konf.Int64("dns_refresh_minutes"))
-				d, _ := time.ParseDuration(min)
-				time.Sleep(d)
-				GS.Vendors = LoadVendors() // do this at startup because it is slow
-			}
-		} else {
-			log.Printf("Warning: `dns_refresh_minutes` is set, but < 5 so ignoring")
-		}
-	}
-	log.Printf("Vendor config loading complete!")
-}
-
 func main() {
 	var cfile string
 	flag.StringVar(&cfile, "config", "", "Path to vpnexiter config.yaml")
 	flag.Parse()
 
 	LoadConfig(cfile)
+	rand.Seed(time.Now().UnixNano())
+	loadState()
+	HostResolver = NewResolver()
+	GS.ServerChanges = NewServerChanges()
+	vpn.LookupHost = HostResolver.LookupHost
 	go loadVendors()
+	go resumeTrial()
 	e := echo.New()
 	e.Use(middleware.Logger()) // debug logging: https://echo.labstack.com/middleware/logger
+	// never trust X-Forwarded-For/X-Real-IP for who the client is
+	e.IPExtractor = echo.ExtractIPDirect()
 
 	// Enable basic auth?
 	if Konf.Exists("listen.username") && Konf.Exists("listen.password") {
@@ -228,6 +229,36 @@ func main() {
 	}
 
 	GS.VPN = vpn.NewVpn(Konf)
+	if Konf.Bool("kill_switch.enabled") {
+		GS.KillSwitch = NewKillSwitch()
+		go GS.KillSwitch.Start()
+	}
+	if Konf.Bool("policy_routing.enabled") {
+		GS.PolicyRouting = NewPolicyRouter()
+		go GS.PolicyRouting.Run()
+	}
+	if Konf.Bool("dns.enabled") {
+		GS.DNS = NewTunnelDNS()
+	}
+	if Konf.Bool("split_tunnel.enabled") {
+		GS.SplitTunnel = &SplitTunnel{}
+		go GS.SplitTunnel.Start()
+	}
+	if Konf.Bool("latency_prober.enabled") {
+		go runLatencyProber()
+	}
+	if Konf.Bool("monitor.enabled") {
+		GS.Monitor = NewHealthMonitor()
+		go GS.Monitor.Run()
+	}
+	if Konf.Bool("schedule.enabled") {
+		GS.Scheduler = NewScheduler()
+		go GS.Scheduler.Run()
+	}
+	if Konf.Bool("rotation.enabled") {
+		GS.Rotation = NewRotation()
+		go GS.Rotation.Run()
+	}
 
 	// serve static content
 	e.Static("/static", "static")
@@ -240,6 +271,7 @@ func main() {
 		"BpsToMbps":    bpsToMbps,
 		"Float64ToInt": float64ToInt,
 		"Float64ToStr": float64ToStr,
+		"PathEscape":   url.PathEscape,
 		// "GenerateMenu": GenerateMenu,
 	}
 	t := &Template{
@@ -251,7 +283,22 @@ func main() {
 	e.GET("/status", Status)
 	e.GET("/status/:action", Status)
 	e.GET("/select_exit", SelectExit)
-	e.GET("/select_exit/:vendor/:exit", SelectExit)
+	e.GET("/select_exit/:vendor/*", SelectExit)
+	e.GET("/select_location/:vendor/*", SelectLocation)
+	e.GET("/select_chain/:name", SelectChain)
+	e.GET("/auto_select/:vendor", AutoSelect)
+	e.GET("/auto_select/:vendor/*", AutoSelect)
+	e.POST("/trial/confirm", TrialConfirm)
+	e.POST("/trial/revert", TrialRevert)
+	e.POST("/rotation/:action", RotationPause)
+	e.GET("/verify", Verify)
+	e.POST("/kill_switch/:action", KillSwitchAction)
+	e.GET("/clients", Clients)
+	e.POST("/clients/assign", ClientAssign)
+	e.GET("/my_exit", MyExit)
+	e.POST("/my_exit", MyExitAssign)
+	e.GET("/split_tunnel", SplitTunnelLists)
+	e.POST("/split_tunnel", SplitTunnelSave)
 
 	// Lots of speed test stuff
 	e.GET("/speedtest/:mode", Speedtest)
@@ -266,29 +313,60 @@ func main() {
 	// return list of vendors
 	e.GET("/vendors", vendors)
 
+	// return the pending trial switch
+	e.GET("/trial", trial)
+
+	// return the schedule rules & upcoming switches
+	e.GET("/schedule", schedule)
+
+	// return the privacy rotation state
+	e.GET("/rotation", rotation)
+
+	// return the last tunnel verification
+	e.GET("/verification", verification)
+
+	// return the kill switch state
+	e.GET("/kill_switch", killSwitch)
+
+	// return the multi-hop chains
+	e.GET("/chains", chainList)
+
+	// return the DNS servers in use
+	e.GET("/dns", dnsStatus)
+
+	// refresh a vendor's servers now & return the loading progress
+	e.POST("/refresh/:vendor", vendorRefresh)
+	e.GET("/progress", progress)
+
+	// return the servers added, removed or changed by the DNS refreshes
+	e.GET("/server_changes", serverChanges)
+
+	// return the policy routing tunnels & clients
+	e.GET("/tunnels", tunnels)
+
+	// return the split tunnel lists
+	e.GET("/split_tunnel/lists", splitTunnel)
+
+	// rank the exits for a vendor (and optional levels), ?switch=1 to use the best
+	e.GET("/rank/:vendor", rank)
+	e.GET("/rank/:vendor/*", rank)
+
 	// return a map of all the exits for a vendor
 	e.GET("/exits/:vendor", exits)
 
+	// return the resolved server tree for a vendor with latency stats
+	e.GET("/tree/:vendor", tree)
+
 	// For the given vendor, return the levels
 	e.GET("/levels/:vendor", levels)
 
 	// For the given vendor, return the keys below the given level
 	e.GET("/level/:vendor", level)
-	e.GET("/level/:vendor/:l0", level)
-	e.GET("/level/:vendor/:l0/:l1", level)
-	e.GET("/level/:vendor/:l0/:l1/:l2", level)
-	e.GET("/level/:vendor/:l0/:l1/:l2/:l3", level)
-	e.GET("/level/:vendor/:l0/:l1/:l2/:l3/:l4", level)
-	e.GET("/level/:vendor/:l0/:l1/:l2/:l3/:l4/:l5", level)
+	e.GET("/level/:vendor/*", level)
 
 	// For the given vendor, return the servers for the given key
 	e.GET("/servers/:vendor", servers)
-	e.GET("/servers/:vendor/:l0", servers)
-	e.GET("/servers/:vendor/:l0/:l1", servers)
-	e.GET("/servers/:vendor/:l0/:l1/:l2", servers)
-	e.GET("/servers/:vendor/:l0/:l1/:l2/:l3", servers)
-	e.GET("/servers/:vendor/:l0/:l1/:l2/:l3/:l4", servers)
-	e.GET("/servers/:vendor/:l0/:l1/:l2/:l3/:l4/:l5", servers)
+	e.GET("/servers/:vendor/*", servers)
 	listen := fmt.Sprintf("%s:%d", Konf.String("listen.address"), Konf.Int("listen.http"))
 	log.Printf("Listening on %s", listen)
 	e.Logger.Fatal(e.Start(listen))
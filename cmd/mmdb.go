@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+/*
+ * Just enough of a MaxMind DB (mmdb) reader to look up the country & ASN
+ * of an IP in the GeoLite2/GeoIP2 (or compatible) databases.
+ * See https://maxmind.github.io/MaxMind-DB/
+ */
+type MMDB struct {
+	buf        []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	dataStart  uint
+	ipv4Start  uint
+}
+
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+func OpenMMDB(fname string) (*MMDB, error) {
+	buf, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%s is not a MaxMind DB file", fname)
+	}
+	metaStart := uint(i + len(mmdbMetadataMarker))
+	meta, _, err := mmdbDecode(buf[metaStart:], 0)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read %s metadata: %s", fname, err.Error())
+	}
+	m, ok := meta.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Invalid %s metadata", fname)
+	}
+	db := &MMDB{buf: buf}
+	for key, val := range map[string]*uint{
+		"node_count":  &db.nodeCount,
+		"record_size": &db.recordSize,
+		"ip_version":  &db.ipVersion,
+	} {
+		v, ok := m[key].(uint64)
+		if !ok {
+			return nil, fmt.Errorf("Invalid %s metadata: missing %s", fname, key)
+		}
+		*val = uint(v)
+	}
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("Unsupported %s record size: %d", fname, db.recordSize)
+	}
+	db.dataStart = db.nodeCount*db.recordSize/4 + 16
+	if db.dataStart > metaStart {
+		return nil, fmt.Errorf("Invalid %s: search tree is larger than the file", fname)
+	}
+
+	// IPv4 addresses live under ::/96 in an IPv6 tree
+	for i := 0; i < 96 && db.ipVersion == 6 && db.ipv4Start < db.nodeCount; i++ {
+		db.ipv4Start = db.record(db.ipv4Start, 0)
+	}
+	return db, nil
+}
+
+func (db *MMDB) record(node uint, bit uint) uint {
+	b := db.buf[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+/*
+ * Returns the record for the IP or nil if there isn't one
+ */
+func (db *MMDB) Lookup(ip net.IP) (map[string]interface{}, error) {
+	addr := ip.To4()
+	node := uint(0)
+	if addr != nil {
+		node = db.ipv4Start
+	} else if db.ipVersion == 4 {
+		return nil, fmt.Errorf("IPv6 lookup in an IPv4 only database")
+	} else {
+		addr = ip.To16()
+	}
+	for i := uint(0); i < uint(len(addr))*8 && node < db.nodeCount; i++ {
+		node = db.record(node, uint(addr[i/8]>>(7-i%8))&1)
+	}
+	if node == db.nodeCount {
+		return nil, nil
+	} else if node < db.nodeCount {
+		return nil, fmt.Errorf("Invalid search tree")
+	}
+	offset := node - db.nodeCount - 16
+	val, _, err := mmdbDecode(db.buf[db.dataStart:], offset)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Unexpected record type %T", val)
+	}
+	return m, nil
+}
+
+// deeper than any real database nests maps & arrays
+const mmdbMaxDepth = 64
+
+/*
+ * Decodes the value at offset in the data section and returns it along
+ * with the offset of the next value
+ */
+func mmdbDecode(data []byte, offset uint) (interface{}, uint, error) {
+	return mmdbDecodeDepth(data, offset, 0, false)
+}
+
+/*
+ * depth counts the maps & arrays (and pointers) we are in, so a pointer
+ * loop in a corrupt database can't recurse forever
+ */
+func mmdbDecodeDepth(data []byte, offset uint, depth int, pointer bool) (interface{}, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, fmt.Errorf("data nested more than %d deep", mmdbMaxDepth)
+	}
+	if offset >= uint(len(data)) {
+		return nil, 0, fmt.Errorf("offset %d out of range", offset)
+	}
+	ctrl := data[offset]
+	offset++
+	dtype := uint(ctrl >> 5)
+
+	if dtype == 1 {
+		if pointer {
+			return nil, 0, fmt.Errorf("pointer to a pointer at offset %d", offset-1)
+		}
+		// pointers have their own size encoding
+		ss := uint(ctrl>>3) & 0x3
+		if offset+ss+1 > uint(len(data)) {
+			return nil, 0, fmt.Errorf("truncated pointer")
+		}
+		vvv := uint(ctrl & 0x7)
+		var ptr uint
+		switch ss {
+		case 0:
+			ptr = vvv<<8 | uint(data[offset])
+		case 1:
+			ptr = (vvv<<16 | uint(data[offset])<<8 | uint(data[offset+1])) + 2048
+		case 2:
+			ptr = (vvv<<24 | uint(data[offset])<<16 | uint(data[offset+1])<<8 | uint(data[offset+2])) + 526336
+		case 3:
+			ptr = uint(binary.BigEndian.Uint32(data[offset:]))
+		}
+		val, _, err := mmdbDecodeDepth(data, ptr, depth+1, true)
+		return val, offset + ss + 1, err
+	}
+
+	if dtype == 0 {
+		if offset >= uint(len(data)) {
+			return nil, 0, fmt.Errorf("truncated extended type")
+		}
+		dtype = 7 + uint(data[offset])
+		offset++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(data)) {
+			return nil, 0, fmt.Errorf("truncated size")
+		}
+		extra := uint(0)
+		for _, b := range data[offset : offset+n] {
+			extra = extra<<8 | uint(b)
+		}
+		size = []uint{29, 285, 65821}[n-1] + extra
+		offset += n
+	}
+
+	switch dtype {
+	case 7: // map
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := mmdbDecodeDepth(data, offset, depth+1, false)
+			if err != nil {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key is a %T", key)
+			}
+			m[k], offset, err = mmdbDecodeDepth(data, next, depth+1, false)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+	case 11: // array
+		a := make([]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var err error
+			a[i], offset, err = mmdbDecodeDepth(data, offset, depth+1, false)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, offset, nil
+	case 14: // boolean, value is the size
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(data)) {
+		return nil, 0, fmt.Errorf("truncated value")
+	}
+	b := data[offset : offset+size]
+	offset += size
+	switch dtype {
+	case 2: // utf-8 string
+		return string(b), offset, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, fmt.Errorf("invalid double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, fmt.Errorf("invalid float size %d", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case 4, 10: // bytes, uint128
+		return append([]byte{}, b...), offset, nil
+	case 5, 6, 9: // uint16, uint32, uint64
+		v := uint64(0)
+		for _, x := range b {
+			v = v<<8 | uint64(x)
+		}
+		return v, offset, nil
+	case 8: // int32
+		v := uint32(0)
+		for _, x := range b {
+			v = v<<8 | uint32(x)
+		}
+		return int64(int32(v)), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type %d", dtype)
+}
+
+/*
+ * Walks a path of map keys in a record, ie: "country", "iso_code"
+ */
+func mmdbGet(record map[string]interface{}, keys ...string) interface{} {
+	var cur interface{} = record
+	for _, key := range keys {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		cur = m[key]
+	}
+	return cur
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+/*
+ * Builds small MaxMind DBs for the tests
+ */
+type mmdbNetwork struct {
+	cidr   string
+	record map[string]interface{}
+}
+
+// encodes a value in the MaxMind DB data format
+func mmdbEncode(value interface{}) []byte {
+	ctrl := func(dtype int, size int) []byte {
+		var b []byte
+		if dtype > 7 {
+			b = []byte{0, byte(dtype - 7)}
+		} else {
+			b = []byte{byte(dtype << 5)}
+		}
+		switch {
+		case size < 29:
+			b[0] |= byte(size)
+		case size < 285:
+			b[0] |= 29
+			b = append(b, byte(size-29))
+		default:
+			b[0] |= 30
+			b = append(b, byte((size-285)>>8), byte(size-285))
+		}
+		return b
+	}
+	uintBytes := func(v uint64) []byte {
+		b := []byte{}
+		for ; v > 0; v >>= 8 {
+			b = append([]byte{byte(v)}, b...)
+		}
+		return b
+	}
+	switch v := value.(type) {
+	case string:
+		return append(ctrl(2, len(v)), v...)
+	case float64:
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, math.Float64bits(v))
+		return append(ctrl(3, 8), b...)
+	case uint16:
+		b := uintBytes(uint64(v))
+		return append(ctrl(5, len(b)), b...)
+	case uint32:
+		b := uintBytes(uint64(v))
+		return append(ctrl(6, len(b)), b...)
+	case uint64:
+		b := uintBytes(v)
+		return append(ctrl(9, len(b)), b...)
+	case bool:
+		if v {
+			return ctrl(14, 1)
+		}
+		return ctrl(14, 0)
+	case []interface{}:
+		b := ctrl(11, len(v))
+		for _, item := range v {
+			b = append(b, mmdbEncode(item)...)
+		}
+		return b
+	case map[string]interface{}:
+		keys := []string{}
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		b := ctrl(7, len(v))
+		for _, key := range keys {
+			b = append(b, mmdbEncode(key)...)
+			b = append(b, mmdbEncode(v[key])...)
+		}
+		return b
+	}
+	panic("unsupported type")
+}
+
+/*
+ * Returns the database with the networks.  IPv4 networks in an IPv6
+ * database go under ::/96.
+ */
+func mmdbBuild(ipVersion int, recordSize uint, networks []mmdbNetwork) []byte {
+	type node struct {
+		children [2]*node
+		data     int
+	}
+	root := &node{data: -1}
+	data := []byte{}
+	offsets := []uint{}
+	for _, n := range networks {
+		_, ipnet, err := net.ParseCIDR(n.cidr)
+		if err != nil {
+			panic(err)
+		}
+		addr := ipnet.IP
+		ones, _ := ipnet.Mask.Size()
+		if ipVersion == 6 {
+			if v4 := addr.To4(); v4 != nil {
+				addr = append(make(net.IP, 12), v4...)
+				ones += 96
+			} else {
+				addr = addr.To16()
+			}
+		}
+		cur := root
+		for i := 0; i < ones; i++ {
+			bit := (addr[i/8] >> (7 - uint(i)%8)) & 1
+			if cur.children[bit] == nil {
+				cur.children[bit] = &node{data: -1}
+			}
+			cur = cur.children[bit]
+		}
+		cur.data = len(offsets)
+		offsets = append(offsets, uint(len(data)))
+		data = append(data, mmdbEncode(n.record)...)
+	}
+
+	// number the nodes breadth first
+	nodes := []*node{root}
+	for i := 0; i < len(nodes); i++ {
+		for _, child := range nodes[i].children {
+			if child != nil && child.data < 0 {
+				nodes = append(nodes, child)
+			}
+		}
+	}
+	ids := map[*node]uint{}
+	for i, n := range nodes {
+		ids[n] = uint(i)
+	}
+	nodeCount := uint(len(nodes))
+	value := func(n *node) uint {
+		if n == nil {
+			return nodeCount
+		} else if n.data >= 0 {
+			return nodeCount + 16 + offsets[n.data]
+		}
+		return ids[n]
+	}
+
+	buf := []byte{}
+	for _, n := range nodes {
+		left, right := value(n.children[0]), value(n.children[1])
+		switch recordSize {
+		case 24:
+			buf = append(buf, byte(left>>16), byte(left>>8), byte(left),
+				byte(right>>16), byte(right>>8), byte(right))
+		case 28:
+			buf = append(buf, byte(left>>16), byte(left>>8), byte(left),
+				byte(left>>24&0x0F)<<4|byte(right>>24&0x0F),
+				byte(right>>16), byte(right>>8), byte(right))
+		case 32:
+			b := make([]byte, 8)
+			binary.BigEndian.PutUint32(b, uint32(left))
+			binary.BigEndian.PutUint32(b[4:], uint32(right))
+			buf = append(buf, b...)
+		}
+	}
+	buf = append(buf, make([]byte, 16)...)
+	buf = append(buf, data...)
+	buf = append(buf, mmdbMetadataMarker...)
+	buf = append(buf, mmdbEncode(map[string]interface{}{
+		"node_count":    uint32(nodeCount),
+		"record_size":   uint16(recordSize),
+		"ip_version":    uint16(ipVersion),
+		"database_type": "Test",
+	})...)
+	return buf
+}
+
+func writeMMDB(t *testing.T, buf []byte) string {
+	f, err := ioutil.TempFile("", "vpnexiter-mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func country(iso string, name string) map[string]interface{} {
+	return map[string]interface{}{
+		"country": map[string]interface{}{
+			"iso_code":   iso,
+			"geoname_id": uint32(2921044),
+			"names":      map[string]interface{}{"en": name},
+		},
+	}
+}
+
+var testNetworks = []mmdbNetwork{
+	{"1.2.3.0/24", country("DE", "Germany")},
+	{"81.0.0.0/8", country("SE", "Sweden")},
+	{"203.0.113.128/25", map[string]interface{}{
+		"autonomous_system_number":       uint32(64500),
+		"autonomous_system_organization": "Example Networks",
+		"is_anycast":                     true,
+		"location":                       []interface{}{float64(59.33), float64(18.06)},
+	}},
+	{"2001:db8::/32", country("NL", "Netherlands")},
+}
+
+func TestMMDBLookup(t *testing.T) {
+	tests := []struct {
+		ip   string
+		keys []string
+		want interface{}
+	}{
+		{"1.2.3.4", []string{"country", "iso_code"}, "DE"},
+		{"1.2.3.255", []string{"country", "names", "en"}, "Germany"},
+		{"1.2.4.1", nil, nil},
+		{"81.200.1.1", []string{"country", "iso_code"}, "SE"},
+		{"81.200.1.1", []string{"country", "geoname_id"}, uint64(2921044)},
+		{"203.0.113.200", []string{"autonomous_system_number"}, uint64(64500)},
+		{"203.0.113.200", []string{"autonomous_system_organization"}, "Example Networks"},
+		{"203.0.113.200", []string{"is_anycast"}, true},
+		{"203.0.113.1", nil, nil},
+		{"2001:db8::1", []string{"country", "iso_code"}, "NL"},
+		{"2001:db9::1", nil, nil},
+	}
+	for _, ipVersion := range []int{4, 6} {
+		for _, recordSize := range []uint{24, 28, 32} {
+			fname := writeMMDB(t, mmdbBuild(ipVersion, recordSize, testNetworks))
+			defer os.Remove(fname)
+			db, err := OpenMMDB(fname)
+			if err != nil {
+				t.Fatalf("IPv%d/%d: %s", ipVersion, recordSize, err.Error())
+			}
+			for _, tt := range tests {
+				ip := net.ParseIP(tt.ip)
+				record, err := db.Lookup(ip)
+				if ipVersion == 4 && ip.To4() == nil {
+					if err == nil {
+						t.Errorf("IPv%d/%d %s: expected an error", ipVersion, recordSize, tt.ip)
+					}
+					continue
+				}
+				if err != nil {
+					t.Errorf("IPv%d/%d %s: %s", ipVersion, recordSize, tt.ip, err.Error())
+					continue
+				}
+				if tt.keys == nil {
+					if record != nil {
+						t.Errorf("IPv%d/%d %s: expected no record, got %v", ipVersion, recordSize, tt.ip, record)
+					}
+					continue
+				}
+				if got := mmdbGet(record, tt.keys...); got != tt.want {
+					t.Errorf("IPv%d/%d %s %s: got %v, want %v", ipVersion, recordSize, tt.ip,
+						strings.Join(tt.keys, "."), got, tt.want)
+				}
+			}
+		}
+	}
+}
+
+func TestOpenMMDBInvalid(t *testing.T) {
+	good := mmdbBuild(4, 24, testNetworks)
+	marker := bytes.LastIndex(good, mmdbMetadataMarker) + len(mmdbMetadataMarker)
+	meta := func(m map[string]interface{}) []byte {
+		return append(append([]byte{}, good[:marker]...), mmdbEncode(m)...)
+	}
+	tests := []struct {
+		name string
+		buf  []byte
+	}{
+		{"empty", []byte{}},
+		{"no metadata", good[:len(good)/2]},
+		{"metadata is not a map", append(append([]byte{}, mmdbMetadataMarker...), mmdbEncode("x")...)},
+		{"missing record_size", meta(map[string]interface{}{"node_count": uint32(1), "ip_version": uint16(4)})},
+		{"bad record_size", meta(map[string]interface{}{"node_count": uint32(1), "record_size": uint16(20), "ip_version": uint16(4)})},
+		{"tree larger than file", meta(map[string]interface{}{"node_count": uint32(100000), "record_size": uint16(24), "ip_version": uint16(4)})},
+	}
+	for _, tt := range tests {
+		fname := writeMMDB(t, tt.buf)
+		defer os.Remove(fname)
+		if _, err := OpenMMDB(fname); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
+
+func TestMMDBDecode(t *testing.T) {
+	str := mmdbEncode("country")
+	tests := []struct {
+		name  string
+		data  []byte
+		start uint
+		want  interface{}
+		next  uint
+		valid bool
+	}{
+		{"string", str, 0, "country", uint(len(str)), true},
+		{"uint16", mmdbEncode(uint16(443)), 0, uint64(443), 3, true},
+		{"double", mmdbEncode(float64(1.5)), 0, float64(1.5), 9, true},
+		{"false", mmdbEncode(false), 0, false, 2, true},
+		{"int32", []byte{4, 1, 0xff, 0xff, 0xff, 0xfe}, 0, int64(-2), 6, true},
+		{"pointer", append(append([]byte{}, str...), 1<<5, 0), uint(len(str)), "country", uint(len(str)) + 2, true},
+		{"long string", mmdbEncode(strings.Repeat("x", 300)), 0, strings.Repeat("x", 300), 303, true},
+		{"empty", []byte{}, 0, nil, 0, false},
+		{"truncated string", mmdbEncode("country")[:4], 0, nil, 0, false},
+		{"truncated pointer", []byte{1<<5 | 1<<3, 0}, 0, nil, 0, false},
+		{"pointer out of range", []byte{1 << 5, 10}, 0, nil, 0, false},
+		{"pointer to a pointer", []byte{1 << 5, 2, 1 << 5, 0}, 0, nil, 0, false},
+		{"pointer to itself", []byte{1 << 5, 0}, 0, nil, 0, false},
+		// a map whose value points back at the map
+		{"pointer loop", append(append([]byte{7<<5 | 1}, mmdbEncode("a")...), 1<<5, 0), 0, nil, 0, false},
+		{"map key is not a string", []byte{7<<5 | 1, 5<<5 | 1, 1, 5<<5 | 1, 1}, 0, nil, 0, false},
+		{"bad double size", []byte{3<<5 | 4, 0, 0, 0, 0}, 0, nil, 0, false},
+		{"unsupported type", []byte{0, 13}, 0, nil, 0, false},
+	}
+	for _, tt := range tests {
+		got, next, err := mmdbDecode(tt.data, tt.start)
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err.Error())
+			continue
+		}
+		if got != tt.want || next != tt.next {
+			t.Errorf("%s: got %v (next %d), want %v (next %d)", tt.name, got, next, tt.want, tt.next)
+		}
+	}
+
+	// nesting deeper than mmdbMaxDepth
+	deep := []byte{}
+	for i := 0; i <= mmdbMaxDepth; i++ {
+		deep = append(deep, mmdbEncode([]interface{}{""})[:2]...)
+	}
+	deep = append(deep, mmdbEncode("x")...)
+	if _, _, err := mmdbDecode(deep, 0); err == nil {
+		t.Errorf("expected an error for %d nested arrays", mmdbMaxDepth+1)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"gopkg.in/grignaak/tribool.v1"
+)
+
+/*
+ * HealthMonitor checks the tunnel every Interval and fails over to the
+ * Backups (in order) and then the best scoring exit in Region after Failures
+ * consecutive failed checks.
+ *
+ * To keep us from flapping, the tunnel is only considered healthy again
+ * after Recoveries consecutive good checks and we never fail over if we
+ * switched less than MinDwell ago.
+ *
+ * If every candidate is down, AllDown decides if we `fail_open` (run the
+ * `monitor.fail_open_command` so traffic can bypass the VPN) or
+ * `fail_closed` (leave everything as is and keep trying).
+ */
+type HealthMonitor struct {
+	Interval   time.Duration
+	Failures   int
+	Recoveries int
+	MinDwell   time.Duration
+	Backups    []ExitSpec
+	Region     *ExitSpec
+	AllDown    string
+	MonitorState
+	mux sync.Mutex // MonitorState is read by the status page
+}
+
+type MonitorState struct {
+	Healthy      bool
+	FailCount    int
+	SuccessCount int
+	FailedOpen   bool
+	LastCheck    time.Time
+	LastEvent    string
+}
+
+// a copy of the runtime state for the status page
+func (hm *HealthMonitor) State() MonitorState {
+	hm.mux.Lock()
+	defer hm.mux.Unlock()
+	return hm.MonitorState
+}
+
+func (hm *HealthMonitor) update(f func(ms *MonitorState)) {
+	hm.mux.Lock()
+	defer hm.mux.Unlock()
+	f(&hm.MonitorState)
+}
+
+func NewHealthMonitor() *HealthMonitor {
+	hm := &HealthMonitor{
+		Interval:   30 * time.Second,
+		Failures:   3,
+		Recoveries: 2,
+		MinDwell:   5 * time.Minute,
+		Backups:    []ExitSpec{},
+		AllDown:    "fail_closed",
+	}
+	hm.Healthy = true
+	if Konf.Int("monitor.interval_seconds") > 0 {
+		hm.Interval = time.Duration(Konf.Int("monitor.interval_seconds")) * time.Second
+	}
+	if Konf.Int("monitor.failures") > 0 {
+		hm.Failures = Konf.Int("monitor.failures")
+	}
+	if Konf.Int("monitor.recoveries") > 0 {
+		hm.Recoveries = Konf.Int("monitor.recoveries")
+	}
+	if Konf.Exists("monitor.min_dwell_seconds") {
+		hm.MinDwell = time.Duration(Konf.Int("monitor.min_dwell_seconds")) * time.Second
+	}
+	for _, k := range Konf.Slices("monitor.backups") {
+		hm.Backups = append(hm.Backups, newExitSpec(k))
+	}
+	if Konf.Exists("monitor.region.vendor") {
+		region := newExitSpec(Konf.Cut("monitor.region"))
+		hm.Region = &region
+	}
+	switch ad := Konf.String("monitor.all_down"); ad {
+	case "":
+	case "fail_open", "fail_closed":
+		hm.AllDown = ad
+	default:
+		log.Printf("Warning: unknown `monitor.all_down` %s, using %s", ad, hm.AllDown)
+	}
+	return hm
+}
+
+/*
+ * Never returns, so call as a goroutine
+ */
+func (hm *HealthMonitor) Run() {
+	log.Printf("Health monitor checking every %s", hm.Interval)
+	for {
+		time.Sleep(hm.Interval)
+		hm.check()
+	}
+}
+
+func (hm *HealthMonitor) check() {
+	if GS.Vendors == nil || GS.Exit == "Unselected" {
+		// nothing to monitor yet
+		return
+	}
+
+	switchMux.Lock()
+	up, err := GS.VPN.IsUp()
+	if err != nil {
+		log.Printf("Health monitor unable to check VPN: %s", err.Error())
+		up = tribool.False
+	}
+	GS.SetState(up)
+	switchMux.Unlock()
+
+	var ms MonitorState
+	hm.update(func(state *MonitorState) {
+		state.LastCheck = time.Now()
+		if up == tribool.True {
+			state.FailCount = 0
+			state.SuccessCount++
+			if !state.Healthy && state.SuccessCount >= hm.Recoveries {
+				log.Printf("Health monitor: %s / %s is healthy again", GS.Vendor, GS.Exit)
+				state.Healthy = true
+			}
+		} else {
+			state.SuccessCount = 0
+			state.FailCount++
+			if state.FailCount >= hm.Failures {
+				state.Healthy = false
+			}
+		}
+		ms = *state
+	})
+	if up == tribool.True {
+		if ms.FailedOpen {
+			log.Printf("Health monitor: %s / %s is back up", GS.Vendor, GS.Exit)
+			hm.restoreFailOpen()
+		}
+		return
+	}
+
+	log.Printf("Health monitor: %s / %s failed %d/%d checks", GS.Vendor, GS.Exit, ms.FailCount, hm.Failures)
+	if ms.FailCount < hm.Failures {
+		return
+	}
+	if dwell := time.Since(GS.SwitchedAt); dwell < hm.MinDwell {
+		log.Printf("Health monitor: only on %s for %s, not failing over yet", GS.Exit, dwell.Round(time.Second))
+		return
+	}
+	if name, ok := automationBlocked(); ok {
+		log.Printf("Health monitor: in exclusion window %s, not failing over", name)
+		return
+	}
+	hm.update(func(state *MonitorState) { state.FailCount = 0 })
+	hm.failover()
+}
+
+func (hm *HealthMonitor) failover() {
+	from := fmt.Sprintf("%s / %s", GS.Vendor, GS.Exit)
+	for _, es := range hm.Backups {
+		exit, err := es.switchTo()
+		if err == nil {
+			hm.failedOver(from, fmt.Sprintf("%s / %s", es.Vendor, exit))
+			return
+		}
+		log.Printf("Health monitor: unable to fail over to %s: %s", es.String(), err.Error())
+	}
+
+	if hm.Region != nil {
+		result, err := autoSelect(hm.Region.Vendor, hm.Region.Location)
+		if err == nil {
+			hm.failedOver(from, fmt.Sprintf("%s / %s", hm.Region.Vendor, result.Selected))
+			return
+		}
+		log.Printf("Health monitor: unable to fail over to %s: %s", hm.Region.String(), err.Error())
+	}
+
+	event := fmt.Sprintf("%s: every exit is down, %s", time.Now().Format(time.RFC1123), hm.AllDown)
+	hm.update(func(state *MonitorState) { state.LastEvent = event })
+	log.Printf("Health monitor: %s", event)
+	if hm.AllDown == "fail_open" && !hm.State().FailedOpen {
+		if _, err := GS.VPN.RunCommands("monitor.fail_open_command"); err != nil {
+			log.Printf("Health monitor: fail_open_command failed: %s", err.Error())
+			return
+		}
+		hm.update(func(state *MonitorState) { state.FailedOpen = true })
+		if GS.KillSwitch != nil {
+			GS.KillSwitch.Lift(liftFailOpen)
+		}
+	}
+}
+
+func (hm *HealthMonitor) failedOver(from string, to string) {
+	event := fmt.Sprintf("%s: failed over from %s to %s", time.Now().Format(time.RFC1123), from, to)
+	log.Printf("Health monitor: %s", event)
+	hm.update(func(state *MonitorState) {
+		state.LastEvent = event
+		state.Healthy = true
+		state.SuccessCount = 0
+	})
+	dropTrial("the health monitor")
+	hm.restoreFailOpen()
+}
+
+/*
+ * Undoes `fail_open` once we have a working tunnel again, be it via a
+ * fail over, a manual switch or the tunnel recovering by itself
+ */
+func (hm *HealthMonitor) restoreFailOpen() {
+	if GS.KillSwitch != nil {
+		GS.KillSwitch.restore(liftFailOpen)
+	}
+	if !hm.State().FailedOpen {
+		return
+	}
+	if _, err := GS.VPN.RunCommands("monitor.fail_open_restore_command"); err != nil {
+		log.Printf("Health monitor: fail_open_restore_command failed: %s", err.Error())
+		return
+	}
+	hm.update(func(state *MonitorState) { state.FailedOpen = false })
+}
@@ -0,0 +1,655 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/synfinatic/vpnexiter/vpn"
+	"gopkg.in/grignaak/tribool.v1"
+)
+
+/*
+ * Policy based routing sends LAN clients (by IP, MAC or subnet) through
+ * the main tunnel (`default`), straight out the WAN (`direct`) or through
+ * one of the extra `policy_routing.tunnels`, each with its own routing
+ * table.  Assigning a client to an exit which isn't up yet switches a
+ * tunnel nobody is using to that exit.
+ *
+ * Each tunnel is its own VpnServer with a fixed `{{.Connection}}` (the
+ * tunnel name) so `config_file`, `start_command`, etc. should use it.
+ */
+type Tunnel struct {
+	Name         string
+	Table        string
+	Interface    string
+	Vendor       string
+	Exit         string
+	ExitPath     []string
+	ConnectedStr string
+	VPN          *vpn.VpnServer `json:"-"`
+}
+
+// What we persist for a tunnel so we know what is up after a restart
+type TunnelState struct {
+	Vendor   string
+	Exit     string
+	ExitPath []string
+}
+
+const (
+	TargetDefault = "default"
+	TargetDirect  = "direct"
+)
+
+/*
+ * Where a client's traffic goes: `default`, `direct` or an exit ID.
+ * `<vendor>/<exit>` also works, but is ambiguous if the exit is listed
+ * in more than one location.
+ */
+type ClientTarget string
+
+/*
+ * The vendor & path of the exit, resolved to the full path once the
+ * vendors are loaded
+ */
+func (ct ClientTarget) exit() (string, []string, bool) {
+	vendor, path, err := parseExitID(string(ct))
+	if err != nil || len(path) == 0 {
+		return "", nil, false
+	}
+	if vc, err := getVendorConfig(vendor); err == nil {
+		if full, err := findExit(&vc.Servers, path); err == nil {
+			path = full
+		}
+	}
+	return vendor, path, true
+}
+
+/*
+ * Is the exit at exitPath (which starts with the vendor) the one at path?
+ * A path of just the server name is matched by name.
+ */
+func onExit(exitPath []string, exit string, vendor string, path []string) bool {
+	if len(exitPath) == 0 || exitPath[0] != vendor {
+		return false
+	}
+	if len(path) == 1 && exit == path[0] {
+		return true
+	}
+	return escapePath(exitPath...) == exitID(vendor, path)
+}
+
+type Lease struct {
+	IP       string
+	MAC      string
+	Hostname string
+}
+
+// A row in the Clients tab
+type Client struct {
+	Match    string // IP, MAC or subnet the assignment is for
+	IP       string
+	MAC      string
+	Hostname string
+	Target   ClientTarget
+	Via      string // tunnel or table the traffic uses
+}
+
+// Data for the rule & route command templates
+type PolicyRule struct {
+	Source    string
+	IPv6      bool
+	Table     string
+	Priority  int
+	Interface string
+}
+
+type PolicyRouter struct {
+	Tunnels      []*Tunnel
+	DirectTable  string
+	BasePriority int
+	SelfService  bool
+	LastError    string
+	LastApplied  time.Time
+	mux          sync.Mutex
+}
+
+func NewPolicyRouter() *PolicyRouter {
+	pr := &PolicyRouter{
+		Tunnels:      []*Tunnel{},
+		DirectTable:  "main",
+		BasePriority: 1000,
+		SelfService:  Konf.Bool("policy_routing.self_service"),
+	}
+	if len(Konf.String("policy_routing.direct_table")) > 0 {
+		pr.DirectTable = Konf.String("policy_routing.direct_table")
+	}
+	if Konf.Int("policy_routing.base_priority") > 0 {
+		pr.BasePriority = Konf.Int("policy_routing.base_priority")
+	}
+
+	psMux.Lock()
+	defer psMux.Unlock()
+	if PS.Tunnels == nil {
+		PS.Tunnels = map[string]TunnelState{}
+	}
+	if PS.Clients == nil {
+		PS.Clients = map[string]ClientTarget{}
+	}
+	for i, k := range Konf.Slices("policy_routing.tunnels") {
+		t := &Tunnel{
+			Name:         k.String("name"),
+			Table:        k.String("table"),
+			Interface:    k.String("interface"),
+			ConnectedStr: "Down",
+			VPN:          vpn.NewVpn(Konf),
+		}
+		if len(t.Name) == 0 || len(t.Table) == 0 {
+			log.Printf("Warning: skipping policy_routing.tunnels %d: needs a `name` and `table`", i)
+			continue
+		}
+		t.VPN.Fixed = true
+		t.VPN.Connection = t.Name
+		if ts, ok := PS.Tunnels[t.Name]; ok {
+			t.Vendor, t.Exit, t.ExitPath = ts.Vendor, ts.Exit, ts.ExitPath
+			t.VPN.Vendor, t.VPN.Exit = ts.Vendor, ts.Exit
+		}
+		pr.Tunnels = append(pr.Tunnels, t)
+	}
+	// assignments from the config file, unless changed in the UI
+	for _, k := range Konf.Slices("policy_routing.clients") {
+		match := k.String("match")
+		if _, ok := PS.Clients[match]; ok {
+			continue
+		}
+		target := ClientTarget(k.String("target"))
+		if len(k.String("id")) > 0 {
+			target = ClientTarget(k.String("id"))
+		} else if len(k.String("exit")) > 0 {
+			target = ClientTarget(exitID(k.String("vendor"), []string{k.String("exit")}))
+		}
+		PS.Clients[match] = target
+	}
+	return pr
+}
+
+/*
+ * Reads the DHCP leases from the router.  Understands the dnsmasq
+ * leases file and the `show dhcp leases` table of EdgeOS/VyOS
+ */
+func (pr *PolicyRouter) Leases() ([]Lease, error) {
+	cmds := GS.VPN.CommandsOr("policy_routing.leases_command", "cat /var/lib/misc/dnsmasq.leases")
+	out, err := GS.VPN.RunTemplates("policy_routing.leases_command", cmds, nil)
+	if err != nil {
+		return nil, err
+	}
+	return parseLeases(out.String()), nil
+}
+
+func parseLeases(out string) []Lease {
+	leases := []Lease{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		lease := Lease{}
+		for _, f := range fields {
+			if len(lease.IP) == 0 && net.ParseIP(f) != nil {
+				lease.IP = f
+			} else if hw, err := net.ParseMAC(f); err == nil && len(lease.MAC) == 0 && len(hw) == 6 {
+				lease.MAC = hw.String()
+			}
+		}
+		if len(lease.IP) == 0 || len(lease.MAC) == 0 {
+			continue
+		}
+		if _, err := strconv.Atoi(fields[0]); err == nil && len(fields) >= 4 {
+			// dnsmasq: <expiry> <mac> <ip> <hostname> <client-id>
+			lease.Hostname = fields[3]
+		} else {
+			lease.Hostname = fields[len(fields)-1]
+		}
+		if lease.Hostname == "*" || lease.Hostname == lease.IP || lease.Hostname == lease.MAC {
+			lease.Hostname = ""
+		}
+		leases = append(leases, lease)
+	}
+	return leases
+}
+
+/*
+ * Returns the client as we store it: an IP or subnet as given or a MAC
+ * in the `aa:bb:cc:dd:ee:ff` form of the leases.  ok is false if it is
+ * none of those.
+ */
+func canonicalMatch(match string) (string, bool) {
+	if net.ParseIP(match) != nil {
+		return match, true
+	}
+	if _, _, err := net.ParseCIDR(match); err == nil {
+		return match, true
+	}
+	// leases only have 48 bit MACs
+	hw, err := net.ParseMAC(match)
+	if err != nil || len(hw) != 6 {
+		return "", false
+	}
+	return hw.String(), true
+}
+
+/*
+ * Returns the tunnel on the exit, nil if it is the main tunnel
+ */
+func (pr *PolicyRouter) tunnelFor(vendor string, path []string) (*Tunnel, bool) {
+	if onExit(GS.ExitPath, GS.Exit, vendor, path) {
+		return nil, true
+	}
+	for _, t := range pr.Tunnels {
+		if onExit(t.ExitPath, t.Exit, vendor, path) {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+/*
+ * A tunnel which no client or split tunnel list is using
+ */
+func (pr *PolicyRouter) freeTunnel(except string) *Tunnel {
+	inUse := map[string]bool{}
+	for _, target := range splitTargets() {
+		if vendor, path, ok := target.exit(); ok {
+			inUse[exitID(vendor, path)] = true
+		}
+	}
+	psMux.Lock()
+	for match, target := range PS.Clients {
+		if match == except {
+			continue
+		}
+		if vendor, path, ok := target.exit(); ok {
+			inUse[exitID(vendor, path)] = true
+		}
+	}
+	psMux.Unlock()
+	for _, t := range pr.Tunnels {
+		if len(t.Exit) == 0 || !inUse[escapePath(t.ExitPath...)] {
+			return t
+		}
+	}
+	return nil
+}
+
+/*
+ * Brings up the tunnel on the given exit and points its table at it
+ */
+func (pr *PolicyRouter) switchTunnel(t *Tunnel, vendor string, path []string) error {
+	vc, err := getVendorConfig(vendor)
+	if err != nil {
+		return err
+	}
+	path, err = findExit(&vc.Servers, path)
+	if err != nil {
+		return err
+	}
+	exit := path[len(path)-1]
+
+	switchMux.Lock()
+	defer switchMux.Unlock()
+	if err = preflightCheck(vendor, exit, path); err != nil {
+		return err
+	}
+	log.Printf("Switching tunnel %s to %s / %s", t.Name, vendor, exit)
+	t.ConnectedStr = "Down"
+	if err = t.VPN.UpdateConfig(vendor, exit, exitInfo(vendor, path)); err != nil {
+		return err
+	}
+	t.Vendor, t.Exit, t.ExitPath = vendor, exit, append([]string{vendor}, path...)
+	psMux.Lock()
+	PS.Tunnels[t.Name] = TunnelState{Vendor: t.Vendor, Exit: t.Exit, ExitPath: t.ExitPath}
+	psMux.Unlock()
+	saveState()
+
+	success, err := t.VPN.Restart()
+	if err != nil {
+		return err
+	} else if !success {
+		return fmt.Errorf("Tunnel %s failed to come up on %s", t.Name, exit)
+	}
+	t.ConnectedStr = "Up"
+
+	cmds := GS.VPN.CommandsOr("policy_routing.route_command", "ip route replace default dev {{.Interface}} table {{.Table}}")
+	_, err = GS.VPN.RunTemplates("policy_routing.route_command", cmds, PolicyRule{Table: t.Table, Interface: t.Interface})
+	return err
+}
+
+/*
+ * Routes the client's traffic via the target, bringing up a tunnel if needed
+ */
+func (pr *PolicyRouter) Assign(match string, target ClientTarget) error {
+	client, ok := canonicalMatch(strings.ToLower(strings.TrimSpace(match)))
+	if !ok {
+		return fmt.Errorf("Invalid client %s: must be an IP, MAC or subnet", match)
+	}
+	match = client
+	if vendor, path, ok := target.exit(); ok {
+		if _, up := pr.tunnelFor(vendor, path); !up {
+			t := pr.freeTunnel(match)
+			if t == nil {
+				return fmt.Errorf("No free tunnel for %s / %s.  Add more `policy_routing.tunnels`", vendor, strings.Join(path, " / "))
+			}
+			if err := pr.switchTunnel(t, vendor, path); err != nil {
+				return err
+			}
+		}
+	} else if target != TargetDefault && target != TargetDirect {
+		return fmt.Errorf("Invalid target %s", target)
+	}
+
+	psMux.Lock()
+	if target == TargetDefault {
+		delete(PS.Clients, match)
+	} else {
+		PS.Clients[match] = target
+	}
+	psMux.Unlock()
+	saveState()
+	log.Printf("Policy routing: %s now uses %s", match, target)
+	return pr.Apply()
+}
+
+/*
+ * Replaces our `ip rule`s with the current assignments
+ */
+func (pr *PolicyRouter) Apply() error {
+	pr.mux.Lock()
+	defer pr.mux.Unlock()
+
+	leases, err := pr.Leases()
+	if err != nil {
+		log.Printf("Policy routing: unable to read DHCP leases: %s", err.Error())
+	}
+	macIPs := map[string]string{}
+	for _, l := range leases {
+		macIPs[l.MAC] = l.IP
+	}
+
+	psMux.Lock()
+	matches := []string{}
+	for match := range PS.Clients {
+		matches = append(matches, match)
+	}
+	installed := PS.PolicyRules
+	psMux.Unlock()
+	sort.Strings(matches)
+
+	rules := []PolicyRule{}
+	for _, match := range matches {
+		psMux.Lock()
+		target := PS.Clients[match]
+		psMux.Unlock()
+		rule := PolicyRule{Source: match, Priority: pr.BasePriority + len(rules)}
+		if hw, err := net.ParseMAC(match); err == nil {
+			ip, ok := macIPs[hw.String()]
+			if !ok {
+				log.Printf("Policy routing: no DHCP lease for %s, skipping", match)
+				continue
+			}
+			rule.Source = ip
+		}
+		if target == TargetDirect {
+			rule.Table = pr.DirectTable
+		} else if vendor, path, ok := target.exit(); ok {
+			t, up := pr.tunnelFor(vendor, path)
+			if !up {
+				log.Printf("Policy routing: %s / %s is not up for %s, skipping", vendor, strings.Join(path, " / "), match)
+				continue
+			} else if t == nil {
+				// the main tunnel handles it
+				continue
+			}
+			rule.Table, rule.Interface = t.Table, t.Interface
+		} else {
+			continue
+		}
+		rule.IPv6 = strings.Contains(rule.Source, ":")
+		rules = append(rules, rule)
+	}
+
+	delCmds := GS.VPN.CommandsOr("policy_routing.del_rule_command", "ip {{if .IPv6}}-6 {{end}}rule del priority {{.Priority}}")
+	for _, rule := range installed {
+		// the rule may already be gone, ie: router reboot
+		GS.VPN.RunTemplates("policy_routing.del_rule_command", delCmds, rule)
+	}
+
+	addCmds := GS.VPN.CommandsOr("policy_routing.add_rule_command", "ip {{if .IPv6}}-6 {{end}}rule add from {{.Source}} lookup {{.Table}} priority {{.Priority}}")
+	installed = []PolicyRule{}
+	pr.LastError = ""
+	for _, rule := range rules {
+		if _, err := GS.VPN.RunTemplates("policy_routing.add_rule_command", addCmds, rule); err != nil {
+			pr.LastError = err.Error()
+			log.Printf("Policy routing: %s", pr.LastError)
+			continue
+		}
+		installed = append(installed, rule)
+	}
+	psMux.Lock()
+	PS.PolicyRules = installed
+	psMux.Unlock()
+	saveState()
+	pr.LastApplied = time.Now()
+	if len(pr.LastError) > 0 {
+		return fmt.Errorf("%s", pr.LastError)
+	}
+	return nil
+}
+
+/*
+ * Every client we know about: DHCP leases plus any assignments
+ */
+func (pr *PolicyRouter) Clients() []Client {
+	leases, err := pr.Leases()
+	if err != nil {
+		log.Printf("Policy routing: unable to read DHCP leases: %s", err.Error())
+	}
+	psMux.Lock()
+	assigned := map[string]ClientTarget{}
+	for match, target := range PS.Clients {
+		assigned[match] = target
+	}
+	psMux.Unlock()
+
+	clients := []Client{}
+	for _, l := range leases {
+		c := Client{Match: l.IP, IP: l.IP, MAC: l.MAC, Hostname: l.Hostname, Target: TargetDefault}
+		if target, ok := assigned[l.MAC]; ok {
+			c.Match, c.Target = l.MAC, target
+		} else if target, ok := assigned[l.IP]; ok {
+			c.Target = target
+		}
+		delete(assigned, c.Match)
+		clients = append(clients, c)
+	}
+	// subnets & clients without a lease
+	for match, target := range assigned {
+		clients = append(clients, Client{Match: match, Target: target})
+	}
+	for i := range clients {
+		clients[i].Via = pr.via(clients[i].Target)
+	}
+	sort.SliceStable(clients, func(i, j int) bool {
+		return clients[i].Match < clients[j].Match
+	})
+	return clients
+}
+
+func (pr *PolicyRouter) via(target ClientTarget) string {
+	if target == TargetDirect {
+		return "WAN, table " + pr.DirectTable
+	}
+	vendor, path, ok := target.exit()
+	if !ok {
+		return fmt.Sprintf("main tunnel (%s / %s)", GS.Vendor, GS.Exit)
+	}
+	t, up := pr.tunnelFor(vendor, path)
+	if !up {
+		return "not connected"
+	} else if t == nil {
+		return "main tunnel"
+	}
+	return fmt.Sprintf("tunnel %s, table %s", t.Name, t.Table)
+}
+
+/*
+ * Exits a client can be assigned to, for the UI
+ */
+func (pr *PolicyRouter) Targets() []ClientTarget {
+	targets := []ClientTarget{TargetDefault, TargetDirect}
+	vendors := []string{}
+	for vendor := range GS.Vendors {
+		vendors = append(vendors, vendor)
+	}
+	sort.Strings(vendors)
+	for _, vendor := range vendors {
+		refs, err := scopeServers(vendor, []string{})
+		if err != nil {
+			continue
+		}
+		for _, ref := range refs {
+			targets = append(targets, ClientTarget(exitID(vendor, ref.Path)))
+		}
+	}
+	return targets
+}
+
+/*
+ * Never returns, so call as a goroutine.  Checks the tunnels and
+ * re-applies the rules every `refresh_seconds` so MAC based clients
+ * follow DHCP changes
+ */
+func (pr *PolicyRouter) Run() {
+	refresh := 5 * time.Minute
+	if Konf.Int("policy_routing.refresh_seconds") > 0 {
+		refresh = time.Duration(Konf.Int("policy_routing.refresh_seconds")) * time.Second
+	}
+	log.Printf("Policy routing with %d tunnels, refreshing every %s", len(pr.Tunnels), refresh)
+	for {
+		for _, t := range pr.Tunnels {
+			if len(t.Exit) == 0 {
+				continue
+			}
+			up, err := t.VPN.IsUp()
+			if err != nil {
+				up = tribool.Maybe
+			}
+			t.ConnectedStr = map[tribool.Tribool]string{tribool.True: "Up", tribool.False: "Down", tribool.Maybe: "Unknown State"}[up]
+		}
+		pr.Apply()
+		time.Sleep(refresh)
+	}
+}
+
+// for the status page: every exit which is up
+func (gs GlobalState) ActiveExits() []string {
+	exits := []string{}
+	if gs.Exit != "Unselected" {
+		exits = append(exits, strings.Join(gs.ExitPath, " / "))
+	}
+	if gs.PolicyRouting != nil {
+		for _, t := range gs.PolicyRouting.Tunnels {
+			if len(t.Exit) > 0 {
+				exits = append(exits, strings.Join(t.ExitPath, " / "))
+			}
+		}
+	}
+	return exits
+}
+
+/*
+ * UI: Clients tab
+ */
+func Clients(c echo.Context) error {
+	if GS.PolicyRouting == nil {
+		return c.Render(http.StatusOK, "error.html", "Policy routing is not enabled")
+	}
+	return c.Render(http.StatusOK, "clients.html", map[string]interface{}{
+		"Router":  GS.PolicyRouting,
+		"Clients": GS.PolicyRouting.Clients(),
+		"Targets": GS.PolicyRouting.Targets(),
+		"Self":    "",
+	})
+}
+
+/*
+ * UI: POST /clients/assign with match=<ip|mac|subnet>&target=<default|direct|exit ID>
+ */
+func ClientAssign(c echo.Context) error {
+	if GS.PolicyRouting == nil {
+		return c.Render(http.StatusOK, "error.html", "Policy routing is not enabled")
+	}
+	err := GS.PolicyRouting.Assign(c.FormValue("match"), ClientTarget(c.FormValue("target")))
+	if err != nil {
+		return c.Render(http.StatusOK, "error.html", err.Error())
+	}
+	return c.Redirect(http.StatusSeeOther, "/#clients")
+}
+
+/*
+ * UI: lets a device pick its own exit if `policy_routing.self_service`.
+ * The device is the address of the connection (see IPExtractor in main())
+ * since the X-Forwarded-For & X-Real-IP headers can claim to be anyone.
+ */
+func MyExit(c echo.Context) error {
+	if GS.PolicyRouting == nil || !GS.PolicyRouting.SelfService {
+		return c.Render(http.StatusOK, "error.html", "Self service exit selection is not enabled")
+	}
+	ip := c.RealIP()
+	clients := []Client{}
+	for _, client := range GS.PolicyRouting.Clients() {
+		if client.IP == ip || client.Match == ip {
+			clients = append(clients, client)
+		}
+	}
+	if len(clients) == 0 {
+		clients = append(clients, Client{Match: ip, IP: ip, Target: TargetDefault, Via: GS.PolicyRouting.via(TargetDefault)})
+	}
+	return c.Render(http.StatusOK, "clients.html", map[string]interface{}{
+		"Router":  GS.PolicyRouting,
+		"Clients": clients,
+		"Targets": GS.PolicyRouting.Targets(),
+		"Self":    ip,
+	})
+}
+
+/*
+ * UI: POST /my_exit with target=<default|direct|exit ID>
+ */
+func MyExitAssign(c echo.Context) error {
+	if GS.PolicyRouting == nil || !GS.PolicyRouting.SelfService {
+		return c.Render(http.StatusOK, "error.html", "Self service exit selection is not enabled")
+	}
+	if err := GS.PolicyRouting.Assign(c.RealIP(), ClientTarget(c.FormValue("target"))); err != nil {
+		return c.Render(http.StatusOK, "error.html", err.Error())
+	}
+	return c.Redirect(http.StatusSeeOther, "/my_exit")
+}
+
+/*
+ * AJAX: tunnels & client assignments
+ */
+func tunnels(c echo.Context) error {
+	if GS.PolicyRouting == nil {
+		return c.String(http.StatusNotFound, "Policy routing is not enabled")
+	}
+	return c.JSONPretty(http.StatusOK, map[string]interface{}{
+		"ActiveExits": GS.ActiveExits(),
+		"Tunnels":     GS.PolicyRouting.Tunnels,
+		"Clients":     GS.PolicyRouting.Clients(),
+	}, " ")
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/synfinatic/vpnexiter/vpn"
+)
+
+/*
+ * Returns the IPs for the server at path, using the resolved ServerMap
+ * when we have it and falling back to DNS
+ */
+func serverIPs(vendor string, exit string, path []string) []string {
+	if net.ParseIP(exit) != nil {
+		return []string{exit}
+	}
+	if vc, err := getVendorConfig(vendor); err == nil {
+		if node, err := vc.Servers.getNode(path); err == nil && node.hasList() {
+			return node.getList()
+		}
+	}
+	addrs, err := vpn.ResolveHost(exit, vpn.AddressFamily(Konf, vendor))
+	if err != nil {
+		log.Printf("Error resolving %s: %s", exit, err.Error())
+		return []string{}
+	}
+	return addrs
+}
+
+/*
+ * Make sure the candidate server is usable & answering before we touch
+ * the current tunnel.  Only probes it if `preflight` is configured.
+ */
+func preflightCheck(vendor string, exit string, path []string) error {
+	if err := serverUsable(vendor, exit, path); err != nil {
+		return err
+	}
+	probe := GS.VPN.GetProbe(vendor)
+	if probe == nil {
+		return nil
+	}
+	ips := serverIPs(vendor, exit, path)
+	err := GS.VPN.ProbeIPs(probe, ips)
+	if err != nil {
+		return fmt.Errorf("Refusing to switch to %s: no %s response from %s (%s).  Current tunnel left untouched.",
+			exit, probe.Protocol, strings.Join(ips, ", "), err.Error())
+	}
+	return nil
+}
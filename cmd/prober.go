@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+ * The latency prober measures every resolved server IP in GS.Vendors in
+ * the background and keeps the last `window` results per IP so the
+ * Select Exit tree can show which exits are closest right now.
+ */
+type LatencyStats struct {
+	Results []LatencyResult
+	Updated time.Time
+}
+
+// What we show for a server
+type LatencySummary struct {
+	AvgMs   float64
+	Loss    float64
+	Samples int
+	Updated time.Time
+}
+
+type LatencyTable struct {
+	mux    sync.Mutex
+	window int
+	stats  map[string]*LatencyStats
+}
+
+var Latency = &LatencyTable{
+	window: 10,
+	stats:  map[string]*LatencyStats{},
+}
+
+func (lt *LatencyTable) Record(lr LatencyResult) {
+	lt.mux.Lock()
+	defer lt.mux.Unlock()
+	ls, ok := lt.stats[lr.IP]
+	if !ok {
+		ls = &LatencyStats{Results: []LatencyResult{}}
+		lt.stats[lr.IP] = ls
+	}
+	ls.Results = append(ls.Results, lr)
+	if len(ls.Results) > lt.window {
+		ls.Results = ls.Results[len(ls.Results)-lt.window:]
+	}
+	ls.Updated = time.Now()
+}
+
+/*
+ * Rolling average RTT & loss for an IP
+ */
+func (lt *LatencyTable) Get(ip string) (LatencySummary, bool) {
+	lt.mux.Lock()
+	defer lt.mux.Unlock()
+	ls, ok := lt.stats[ip]
+	if !ok {
+		return LatencySummary{}, false
+	}
+	var sum LatencyResult
+	for _, lr := range ls.Results {
+		sum.Sent += lr.Sent
+		sum.RTTs = append(sum.RTTs, lr.RTTs...)
+	}
+	return LatencySummary{
+		AvgMs:   sum.AvgMs(),
+		Loss:    sum.Loss(),
+		Samples: sum.Sent,
+		Updated: ls.Updated,
+	}, true
+}
+
+/*
+ * Latency of a server in the tree.  For a FQDN it is the best of its IPs.
+ */
+func (sm *ServerMap) latencyOf(name string) (LatencySummary, bool) {
+	if net.ParseIP(name) != nil {
+		return Latency.Get(name)
+	}
+	child, ok := sm.getMap()[name]
+	if !ok {
+		return LatencySummary{}, false
+	}
+	var best LatencySummary
+	found := false
+	for _, ip := range child.getList() {
+		ls, ok := Latency.Get(ip)
+		if ok && (!found || ls.better(best)) {
+			best = ls
+			found = true
+		}
+	}
+	return best, found
+}
+
+func (ls LatencySummary) down() bool {
+	return ls.Samples > 0 && ls.Loss >= 100.0
+}
+
+func (ls LatencySummary) better(other LatencySummary) bool {
+	if ls.down() != other.down() {
+		return !ls.down()
+	}
+	return ls.AvgMs < other.AvgMs
+}
+
+/*
+ * Sorts the servers by latency, unknown latency last
+ */
+func (sm *ServerMap) sortByLatency(names []string) []string {
+	sorted := append([]string{}, names...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, aok := sm.latencyOf(sorted[i])
+		b, bok := sm.latencyOf(sorted[j])
+		if aok != bok {
+			return aok
+		}
+		return aok && a.better(b)
+	})
+	return sorted
+}
+
+/*
+ * HTML badge for the server, or nothing if we haven't measured it
+ */
+func (sm *ServerMap) latencyBadge(name string) template.HTML {
+	ls, ok := sm.latencyOf(name)
+	if !ok {
+		return ""
+	}
+	if ls.down() {
+		return `<span class="latency latency-down">down</span>`
+	}
+	class := "latency-good"
+	if ls.AvgMs >= 150 {
+		class = "latency-bad"
+	} else if ls.AvgMs >= 50 {
+		class = "latency-ok"
+	}
+	label := fmt.Sprintf("%.0fms", ls.AvgMs)
+	if ls.Loss > 0 {
+		label = fmt.Sprintf("%s %.0f%% loss", label, ls.Loss)
+	}
+	return template.HTML(fmt.Sprintf(`<span class="latency %s">%s</span>`, class, label))
+}
+
+/*
+ * Every IP address in the tree
+ */
+func (sm *ServerMap) allIPs() []string {
+	ips := []string{}
+	for _, s := range sm.getList() {
+		if net.ParseIP(s) != nil {
+			ips = append(ips, s)
+		}
+	}
+	for _, child := range sm.getMap() {
+		ips = append(ips, child.allIPs()...)
+	}
+	return ips
+}
+
+/*
+ * Never returns, so call as a goroutine
+ */
+func runLatencyProber() {
+	interval := 5 * time.Minute
+	if Konf.Int("latency_prober.interval_seconds") > 0 {
+		interval = time.Duration(Konf.Int("latency_prober.interval_seconds")) * time.Second
+	}
+	concurrency := 20
+	if Konf.Int("latency_prober.concurrency") > 0 {
+		concurrency = Konf.Int("latency_prober.concurrency")
+	}
+	if Konf.Int("latency_prober.window") > 0 {
+		Latency.window = Konf.Int("latency_prober.window")
+	}
+	lp := getLatencyProbe("latency_prober")
+	log.Printf("Latency prober checking every %s", interval)
+
+	for {
+		if GS.Vendors != nil {
+			seen := map[string]bool{}
+			ips := []string{}
+			for _, vc := range GS.Vendors {
+				for _, ip := range vc.Servers.allIPs() {
+					if !seen[ip] {
+						seen[ip] = true
+						ips = append(ips, ip)
+					}
+				}
+			}
+			begin := time.Now()
+			for _, lr := range lp.MeasureAll(ips, concurrency) {
+				Latency.Record(lr)
+			}
+			log.Printf("Latency prober measured %d IPs in %.2fsec", len(ips), time.Since(begin).Seconds())
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+/*
+ * Progress of loading each vendor, for the Select Exit tab while we
+ * start up & the `/progress` AJAX call
+ */
+type VendorProgress struct {
+	Loading  bool
+	Hosts    int // hostnames to resolve
+	Resolved int
+	Errors   []string
+	Started  time.Time
+	Finished time.Time
+}
+
+type LoadProgress struct {
+	mux     sync.Mutex
+	vendors map[string]*VendorProgress
+}
+
+var Loading = &LoadProgress{
+	vendors: map[string]*VendorProgress{},
+}
+
+func (lp *LoadProgress) start(vendor string, hosts int) {
+	lp.mux.Lock()
+	defer lp.mux.Unlock()
+	lp.vendors[vendor] = &VendorProgress{
+		Loading: true,
+		Hosts:   hosts,
+		Errors:  []string{},
+		Started: time.Now(),
+	}
+}
+
+func (lp *LoadProgress) resolved(vendor string, host string, err error) {
+	lp.mux.Lock()
+	defer lp.mux.Unlock()
+	vp, ok := lp.vendors[vendor]
+	if !ok {
+		return
+	}
+	vp.Resolved++
+	if err != nil {
+		vp.Errors = append(vp.Errors, fmt.Sprintf("%s: %s", host, err.Error()))
+	}
+}
+
+func (lp *LoadProgress) finish(vendor string) {
+	lp.mux.Lock()
+	defer lp.mux.Unlock()
+	if vp, ok := lp.vendors[vendor]; ok {
+		vp.Loading = false
+		vp.Finished = time.Now()
+	}
+}
+
+/*
+ * Marks the vendor as loading.  false if it already is.
+ */
+func (lp *LoadProgress) claim(vendor string) bool {
+	lp.mux.Lock()
+	defer lp.mux.Unlock()
+	if vp, ok := lp.vendors[vendor]; ok && vp.Loading {
+		return false
+	}
+	lp.vendors[vendor] = &VendorProgress{Loading: true, Errors: []string{}, Started: time.Now()}
+	return true
+}
+
+/*
+ * Totals over every configured vendor
+ */
+type ProgressSummary struct {
+	Vendors     int
+	VendorsDone int
+	Hosts       int
+	Resolved    int
+	Errors      []string
+	Loading     []string // vendors being loaded right now
+	PerVendor   map[string]VendorProgress
+}
+
+func (ps ProgressSummary) Done() bool {
+	return ps.VendorsDone == ps.Vendors && len(ps.Loading) == 0
+}
+
+func (lp *LoadProgress) Summary() ProgressSummary {
+	lp.mux.Lock()
+	defer lp.mux.Unlock()
+	ps := ProgressSummary{
+		Errors:    []string{},
+		Loading:   []string{},
+		PerVendor: map[string]VendorProgress{},
+	}
+	for _, vendor := range Konf.Strings("vendors") {
+		ps.Vendors++
+		vp, ok := lp.vendors[vendor]
+		if !ok {
+			continue
+		}
+		if vp.Loading {
+			ps.Loading = append(ps.Loading, vendor)
+		} else {
+			ps.VendorsDone++
+		}
+		ps.Hosts += vp.Hosts
+		ps.Resolved += vp.Resolved
+		ps.Errors = append(ps.Errors, vp.Errors...)
+		ps.PerVendor[vendor] = *vp
+	}
+	sort.Strings(ps.Errors)
+	return ps
+}
+
+// GS.Vendors is replaced, never modified, so readers don't need this
+var vendorsMux sync.Mutex
+
+/*
+ * Call in a goroutine because this blocks in a long sleep() loop
+ * Allows us to asyncly load our GS.Vendors at startup and then
+ * refresh each vendor as its DNS records expire, but no more often than
+ * every `<vendor>.refresh_minutes` or `dns_refresh_minutes`
+ */
+func loadVendors() {
+	if vendors, refreshed := loadCatalog(); vendors != nil {
+		for _, vc := range vendors {
+			vc.Stale = true
+		}
+		vendorsMux.Lock()
+		GS.Vendors, GS.VendorsRefreshed, GS.VendorsStale = vendors, refreshed, true
+		vendorsMux.Unlock()
+		log.Printf("Loaded %d vendors from the catalog_file, refreshing", len(vendors))
+	}
+	// publish them all at once, since GS.Vendors == nil means we are loading
+	vendors := LoadVendors()
+	publishVendors(vendors)
+	log.Printf("Vendor config loading complete!")
+
+	for _, vendor := range Konf.Strings("vendors") {
+		go refreshLoop(vendor)
+	}
+}
+
+/*
+ * Minimum time between refreshes of the vendor.  Zero if not set.
+ */
+func refreshInterval(vendor string) time.Duration {
+	key := vendor + ".refresh_minutes"
+	if !Konf.Exists(key) {
+		key = "dns_refresh_minutes"
+	}
+	if !Konf.Exists(key) {
+		return 0
+	}
+	if Konf.Int64(key) <= 0 {
+		log.Printf("Warning: `%s` must be > 0, ignoring", key)
+		return 0
+	}
+	return time.Duration(Konf.Int64(key)) * time.Minute
+}
+
+/*
+ * Refreshes the vendor as its DNS records expire.  Never returns unless
+ * the vendor has nothing to resolve.
+ */
+func refreshLoop(vendor string) {
+	if !Konf.Bool(vendor+".resolve_servers") || HostResolver == nil {
+		return
+	}
+	hosts := configHosts(vendor)
+	interval := refreshInterval(vendor)
+	for {
+		next := HostResolver.NextExpiry(hosts)
+		if next.IsZero() {
+			// nothing was resolved, so nothing to refresh
+			return
+		}
+		wait := time.Until(next)
+		if wait < interval {
+			wait = interval
+		}
+		if wait < HostResolver.MinTTL {
+			// a host which is still expired after the refresh (ie: it
+			// is no longer in the vendor's servers) can't make us spin
+			wait = HostResolver.MinTTL
+		}
+		time.Sleep(wait)
+		refreshVendor(vendor)
+	}
+}
+
+/*
+ * Reloads one vendor & swaps it into GS.Vendors
+ */
+func refreshVendor(vendor string) {
+	publishVendors(map[string]*VendorConfig{vendor: LoadVendor(vendor)})
+}
+
+/*
+ * Replaces the given vendors in GS.Vendors and saves the catalog_file
+ */
+func publishVendors(vendors map[string]*VendorConfig) {
+	vendorsMux.Lock()
+	defer vendorsMux.Unlock()
+	recordServerChanges(GS.Vendors, vendors)
+
+	merged := map[string]*VendorConfig{}
+	for name, vc := range GS.Vendors {
+		merged[name] = vc
+	}
+	for name, vc := range vendors {
+		merged[name] = vc
+	}
+	stale := false
+	for _, vc := range merged {
+		stale = stale || vc.Stale
+	}
+	GS.Vendors, GS.VendorsRefreshed, GS.VendorsStale = merged, time.Now(), stale
+	saveCatalog(merged, GS.VendorsRefreshed)
+}
+
+/*
+ * AJAX: refresh the vendor now, ignoring the cached DNS answers
+ */
+func vendorRefresh(c echo.Context) error {
+	vendor := pathParam(c, "vendor")
+	if _, err := configLevel(vendor, []string{}); err != nil {
+		return c.String(http.StatusNotFound, err.Error())
+	}
+	if Loading.claim(vendor) {
+		if HostResolver != nil {
+			HostResolver.Forget(configHosts(vendor))
+		}
+		log.Printf("Refreshing %s on request", vendor)
+		go refreshVendor(vendor)
+	}
+	return c.JSONPretty(http.StatusAccepted, Loading.Summary(), " ")
+}
+
+/*
+ * AJAX: how far along loading the vendors is
+ */
+func progress(c echo.Context) error {
+	return c.JSONPretty(http.StatusOK, Loading.Summary(), " ")
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+/*
+ * Resolves the server hostnames for the ServerMap.  Answers are cached
+ * for their record TTL (clamped to `resolver.min_ttl_seconds` and
+ * `resolver.max_ttl_seconds`) and LoadVendors() resolves all of a
+ * vendor's hostnames up front with a pool of `resolver.workers`.
+ *
+ * Queries go to `resolver.server` if set, since lookups via the tunnel's
+ * DNS servers can return geo-steered answers for wherever we currently
+ * exit.  Otherwise the nameservers in /etc/resolv.conf are used.
+ */
+type Resolver struct {
+	Servers []string // host:port
+	Workers int
+	MinTTL  time.Duration
+	MaxTTL  time.Duration
+	Timeout time.Duration
+	cache   map[string]resolverEntry
+	mux     sync.Mutex
+}
+
+type resolverEntry struct {
+	Addrs   []string
+	Err     error
+	Expires time.Time
+}
+
+var HostResolver *Resolver
+
+func NewResolver() *Resolver {
+	r := &Resolver{
+		Servers: []string{},
+		Workers: 16,
+		MinTTL:  5 * time.Minute,
+		MaxTTL:  24 * time.Hour,
+		Timeout: 5 * time.Second,
+		cache:   map[string]resolverEntry{},
+	}
+	if Konf.Int("resolver.workers") > 0 {
+		r.Workers = Konf.Int("resolver.workers")
+	}
+	if Konf.Int("resolver.min_ttl_seconds") > 0 {
+		r.MinTTL = time.Duration(Konf.Int("resolver.min_ttl_seconds")) * time.Second
+	}
+	if Konf.Int("resolver.max_ttl_seconds") > 0 {
+		r.MaxTTL = time.Duration(Konf.Int("resolver.max_ttl_seconds")) * time.Second
+	}
+	if Konf.Int("resolver.timeout_seconds") > 0 {
+		r.Timeout = time.Duration(Konf.Int("resolver.timeout_seconds")) * time.Second
+	}
+
+	servers := Konf.Strings("resolver.server")
+	if len(servers) == 0 && len(Konf.String("resolver.server")) > 0 {
+		servers = []string{Konf.String("resolver.server")}
+	}
+	if len(servers) == 0 {
+		servers = systemNameservers("/etc/resolv.conf")
+	}
+	for _, s := range servers {
+		if net.ParseIP(s) != nil {
+			s = net.JoinHostPort(s, "53")
+		}
+		r.Servers = append(r.Servers, s)
+	}
+	if len(r.Servers) == 0 {
+		log.Printf("Warning: no nameservers, using the system resolver without TTLs")
+	}
+	return r
+}
+
+func systemNameservers(fname string) []string {
+	servers := []string{}
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return servers
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" && net.ParseIP(fields[1]) != nil {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
+
+/*
+ * Returns the cached addresses (A records first) for host, resolving it
+ * if we don't have an unexpired answer.  Failures are cached for MinTTL.
+ */
+func (r *Resolver) LookupHost(host string) ([]string, error) {
+	r.mux.Lock()
+	entry, ok := r.cache[host]
+	r.mux.Unlock()
+	if ok && time.Now().Before(entry.Expires) {
+		return entry.Addrs, entry.Err
+	}
+
+	addrs, ttl, err := r.lookup(host)
+	if ttl < r.MinTTL {
+		ttl = r.MinTTL
+	} else if ttl > r.MaxTTL {
+		ttl = r.MaxTTL
+	}
+	r.mux.Lock()
+	r.cache[host] = resolverEntry{Addrs: addrs, Err: err, Expires: time.Now().Add(ttl)}
+	r.mux.Unlock()
+	return addrs, err
+}
+
+/*
+ * Resolves all the hosts using Workers goroutines to warm the cache.
+ * done (if not nil) is called after each lookup.
+ */
+func (r *Resolver) ResolveAll(hosts []string, done func(string, error)) {
+	jobs := make(chan string)
+	wg := sync.WaitGroup{}
+	for i := 0; i < r.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for host := range jobs {
+				_, err := r.LookupHost(host)
+				if done != nil {
+					done(host, err)
+				}
+			}
+		}()
+	}
+	for _, host := range uniqueHosts(hosts) {
+		jobs <- host
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+/*
+ * Drops the cached answers for the hosts so they are looked up again
+ */
+func (r *Resolver) Forget(hosts []string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for _, host := range hosts {
+		delete(r.cache, host)
+	}
+}
+
+/*
+ * The hostnames (not IPs) in hosts without duplicates
+ */
+func uniqueHosts(hosts []string) []string {
+	unique := []string{}
+	seen := map[string]bool{}
+	for _, host := range hosts {
+		if !seen[host] && net.ParseIP(host) == nil {
+			seen[host] = true
+			unique = append(unique, host)
+		}
+	}
+	return unique
+}
+
+/*
+ * When the first cached answer for the hosts (or any host if nil) expires.
+ * Zero time if none are cached.
+ */
+func (r *Resolver) NextExpiry(hosts []string) time.Time {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if hosts == nil {
+		for host := range r.cache {
+			hosts = append(hosts, host)
+		}
+	}
+	next := time.Time{}
+	for _, host := range hosts {
+		entry, ok := r.cache[host]
+		if ok && (next.IsZero() || entry.Expires.Before(next)) {
+			next = entry.Expires
+		}
+	}
+	return next
+}
+
+func (r *Resolver) lookup(host string) ([]string, time.Duration, error) {
+	if len(r.Servers) == 0 {
+		addrs, err := net.LookupHost(host)
+		return addrs, r.MinTTL, err
+	}
+	addrs := []string{}
+	var ttl uint32
+	var err error
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		a, t, qerr := r.query(host, qtype)
+		if qerr != nil {
+			err = qerr
+			continue
+		}
+		if len(a) > 0 && (len(addrs) == 0 || t < ttl) {
+			ttl = t
+		}
+		addrs = append(addrs, a...)
+	}
+	if len(addrs) > 0 {
+		return addrs, time.Duration(ttl) * time.Second, nil
+	}
+	if err == nil {
+		err = fmt.Errorf("no such host")
+	}
+	return addrs, r.MinTTL, fmt.Errorf("lookup %s: %s", host, err.Error())
+}
+
+/*
+ * Asks each server in turn until one answers.  Returns the addresses &
+ * lowest TTL in the answer.
+ */
+func (r *Resolver) query(host string, qtype dnsmessage.Type) ([]string, uint32, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(rand.Intn(65536)), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for _, server := range r.Servers {
+		var resp []byte
+		resp, err = r.exchange(server, "udp", packed)
+		if err == nil {
+			var h dnsmessage.Header
+			var p dnsmessage.Parser
+			if h, err = p.Start(resp); err == nil && h.Truncated {
+				resp, err = r.exchange(server, "tcp", packed)
+			}
+		}
+		if err != nil {
+			continue
+		}
+		return parseAnswer(resp, msg.Header.ID)
+	}
+	return nil, 0, err
+}
+
+func (r *Resolver) exchange(server string, network string, packed []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(network, server, r.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(r.Timeout))
+
+	if network == "udp" {
+		if _, err = conn.Write(packed); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		return buf[:n], err
+	}
+
+	// TCP messages have a 2 byte length prefix
+	buf := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(buf, uint16(len(packed)))
+	copy(buf[2:], packed)
+	if _, err = conn.Write(buf); err != nil {
+		return nil, err
+	}
+	if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(buf[:2]))
+	_, err = io.ReadFull(conn, resp)
+	return resp, err
+}
+
+func parseAnswer(resp []byte, id uint16) ([]string, uint32, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return nil, 0, err
+	}
+	if h.ID != id {
+		return nil, 0, fmt.Errorf("DNS response ID mismatch")
+	}
+	if h.RCode == dnsmessage.RCodeNameError {
+		return nil, 0, fmt.Errorf("no such host")
+	} else if h.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, fmt.Errorf("server returned %s", h.RCode.String())
+	}
+	if err = p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+
+	addrs := []string{}
+	var ttl uint32
+	for first := true; ; first = false {
+		ah, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+		var ip net.IP
+		switch ah.Type {
+		case dnsmessage.TypeA:
+			a, err := p.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ip = net.IP(a.A[:])
+		case dnsmessage.TypeAAAA:
+			a, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ip = net.IP(a.AAAA[:])
+		default:
+			// ie: the CNAMEs on the way to the address
+			if err = p.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+		}
+		if first || ah.TTL < ttl {
+			ttl = ah.TTL
+		}
+		if ip != nil {
+			addrs = append(addrs, ip.String())
+		}
+	}
+	return addrs, ttl, nil
+}
+
+/*
+ * Every server hostname in the config of the vendor
+ */
+func configHosts(vendor string) []string {
+	level, err := configLevel(vendor, []string{})
+	if err != nil {
+		return []string{}
+	}
+	return uniqueHosts(level.allServers())
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+/*
+ * Privacy rotation switches to a random exit in one of the Scopes every
+ * Interval, never reusing one of the last History exits.  Candidates
+ * the latency prober or the preflight probe say are down are skipped.
+ */
+type Rotation struct {
+	Interval     time.Duration
+	History      int
+	Scopes       []ExitSpec
+	NextRotation time.Time
+	LastEvent    string
+}
+
+// The part of the rotation which survives a restart
+type RotationState struct {
+	Paused       bool
+	Recent       []string // exit IDs, oldest first
+	LastRotation time.Time
+}
+
+func NewRotation() *Rotation {
+	r := &Rotation{
+		Interval: 6 * time.Hour,
+		History:  5,
+		Scopes:   []ExitSpec{},
+	}
+	if Konf.Int("rotation.interval_hours") > 0 {
+		r.Interval = time.Duration(Konf.Int("rotation.interval_hours")) * time.Hour
+	}
+	if Konf.Exists("rotation.history") {
+		r.History = Konf.Int("rotation.history")
+		if r.History < 0 {
+			log.Printf("Warning: `rotation.history` can't be negative, using 0")
+			r.History = 0
+		}
+	}
+	for _, k := range Konf.Slices("rotation.scopes") {
+		r.Scopes = append(r.Scopes, newExitSpec(k))
+	}
+	psMux.Lock()
+	r.NextRotation = PS.Rotation.LastRotation.Add(r.Interval)
+	psMux.Unlock()
+	if r.NextRotation.Before(time.Now()) {
+		r.NextRotation = time.Now().Add(r.Interval)
+	}
+	return r
+}
+
+/*
+ * Never returns, so call as a goroutine
+ */
+func (r *Rotation) Run() {
+	log.Printf("Rotating exits every %s across %d scopes", r.Interval, len(r.Scopes))
+	for GS.Vendors == nil {
+		time.Sleep(time.Second)
+	}
+	for {
+		if time.Now().After(r.NextRotation) && !r.Paused() {
+			r.rotate()
+		}
+		// check every minute so pausing & exclusion windows take effect quickly
+		time.Sleep(time.Minute)
+	}
+}
+
+func (r *Rotation) Paused() bool {
+	psMux.Lock()
+	defer psMux.Unlock()
+	return PS.Rotation.Paused
+}
+
+func (r *Rotation) SetPaused(paused bool) {
+	psMux.Lock()
+	PS.Rotation.Paused = paused
+	psMux.Unlock()
+	saveState()
+	log.Printf("Rotation paused: %v", paused)
+}
+
+/*
+ * Every server in the scopes we are allowed to rotate to, in random order
+ */
+func (r *Rotation) candidates() []ServerRef {
+	psMux.Lock()
+	recent := map[string]bool{}
+	for _, id := range PS.Rotation.Recent {
+		recent[id] = true
+	}
+	psMux.Unlock()
+	recent[GS.ExitID()] = true
+
+	refs := []ServerRef{}
+	for _, scope := range r.Scopes {
+		servers, err := scopeServers(scope.Vendor, scope.Location)
+		if err != nil {
+			log.Printf("Rotation: skipping scope %s: %s", scope.String(), err.Error())
+			continue
+		}
+		for _, ref := range servers {
+			if !recent[exitID(ref.Vendor, ref.Path)] && !knownDown(ref.IPs) {
+				refs = append(refs, ref)
+			}
+		}
+	}
+	rand.Shuffle(len(refs), func(i, j int) { refs[i], refs[j] = refs[j], refs[i] })
+	return refs
+}
+
+/*
+ * true if the latency prober has measured every IP and they are all down
+ */
+func knownDown(ips []string) bool {
+	if len(ips) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		ls, ok := Latency.Get(ip)
+		if !ok || !ls.down() {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Rotation) rotate() {
+	if name, ok := automationBlocked(); ok {
+		log.Printf("Rotation: in exclusion window %s, waiting", name)
+		return
+	}
+	if GS.PendingTrial() != nil {
+		log.Printf("Rotation: trial switch pending, waiting")
+		return
+	}
+	r.NextRotation = time.Now().Add(r.Interval)
+
+	switchMux.Lock()
+	defer switchMux.Unlock()
+	from := GS.ExitID()
+	for _, ref := range r.candidates() {
+		err := trySwitch(ref.Vendor, ref.Server, ref.Path)
+		if err != nil {
+			log.Printf("Rotation: skipping %s: %s", exitID(ref.Vendor, ref.Path), err.Error())
+			continue
+		}
+		r.rotated(from, exitID(ref.Vendor, ref.Path))
+		return
+	}
+	r.LastEvent = fmt.Sprintf("%s: no usable exit to rotate to", time.Now().Format(time.RFC1123))
+	log.Printf("Rotation: %s", r.LastEvent)
+}
+
+func (r *Rotation) rotated(from string, to string) {
+	r.LastEvent = fmt.Sprintf("%s: rotated from %s to %s", time.Now().Format(time.RFC1123), from, to)
+	log.Printf("Rotation: %s", r.LastEvent)
+	psMux.Lock()
+	PS.Rotation.LastRotation = time.Now()
+	PS.Rotation.Recent = append(PS.Rotation.Recent, to)
+	if len(PS.Rotation.Recent) > r.History {
+		PS.Rotation.Recent = PS.Rotation.Recent[len(PS.Rotation.Recent)-r.History:]
+	}
+	psMux.Unlock()
+	saveState()
+	dropTrial("rotation")
+}
+
+/*
+ * UI: POST /rotation/pause or /rotation/resume
+ */
+func RotationPause(c echo.Context) error {
+	if GS.Rotation == nil {
+		return c.Render(http.StatusOK, "error.html", "Rotation is not enabled")
+	}
+	switch c.Param("action") {
+	case "pause":
+		GS.Rotation.SetPaused(true)
+	case "resume":
+		GS.Rotation.SetPaused(false)
+	default:
+		return c.Render(http.StatusOK, "error.html", fmt.Sprintf("Invalid action: %s", c.Param("action")))
+	}
+	return c.Redirect(http.StatusSeeOther, "/#status")
+}
+
+/*
+ * AJAX: rotation state
+ */
+func rotation(c echo.Context) error {
+	if GS.Rotation == nil {
+		return c.String(http.StatusNotFound, "Rotation is not enabled")
+	}
+	psMux.Lock()
+	state := PS.Rotation
+	psMux.Unlock()
+	return c.JSONPretty(http.StatusOK, map[string]interface{}{
+		"Paused":       state.Paused,
+		"Recent":       state.Recent,
+		"LastRotation": state.LastRotation,
+		"NextRotation": GS.Rotation.NextRotation,
+		"LastEvent":    GS.Rotation.LastEvent,
+	}, " ")
+}
+
+// for the status page
+func (gs GlobalState) RotationPaused() bool {
+	return gs.Rotation != nil && gs.Rotation.Paused()
+}
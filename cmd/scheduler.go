@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+/*
+ * The Scheduler switches to the Target of each rule whenever its cron
+ * spec fires (in the local time of this host).  No automation (scheduled
+ * switches, failover, etc) is allowed to switch during an exclusion window.
+ */
+type ScheduleRule struct {
+	Name       string
+	Cron       *CronSchedule
+	Target     ExitSpec
+	LastRun    time.Time
+	LastResult string
+}
+
+type ExclusionWindow struct {
+	Name     string
+	Cron     *CronSchedule
+	Duration time.Duration
+}
+
+type Scheduler struct {
+	Rules      []*ScheduleRule
+	Exclusions []*ExclusionWindow
+}
+
+// An upcoming scheduled switch for the UI
+type ScheduledAction struct {
+	Time     time.Time
+	Rule     string
+	Target   string
+	Excluded string // name of the exclusion window which will block it
+}
+
+func NewScheduler() *Scheduler {
+	s := &Scheduler{
+		Rules:      []*ScheduleRule{},
+		Exclusions: []*ExclusionWindow{},
+	}
+	for i, k := range Konf.Slices("schedule.rules") {
+		cs, err := ParseCron(k.String("cron"))
+		if err != nil {
+			log.Printf("Warning: skipping schedule rule %d: %s", i, err.Error())
+			continue
+		}
+		rule := &ScheduleRule{
+			Name:   k.String("name"),
+			Cron:   cs,
+			Target: newExitSpec(k),
+		}
+		if len(rule.Name) == 0 {
+			rule.Name = rule.Target.String()
+		}
+		s.Rules = append(s.Rules, rule)
+	}
+	for i, k := range Konf.Slices("schedule.exclusions") {
+		cs, err := ParseCron(k.String("cron"))
+		if err != nil {
+			log.Printf("Warning: skipping schedule exclusion %d: %s", i, err.Error())
+			continue
+		}
+		if k.Int("duration_minutes") < 1 {
+			log.Printf("Warning: skipping schedule exclusion %d: `duration_minutes` must be > 0", i)
+			continue
+		}
+		ew := &ExclusionWindow{
+			Name:     k.String("name"),
+			Cron:     cs,
+			Duration: time.Duration(k.Int("duration_minutes")) * time.Minute,
+		}
+		if len(ew.Name) == 0 {
+			ew.Name = cs.Spec
+		}
+		s.Exclusions = append(s.Exclusions, ew)
+	}
+	return s
+}
+
+/*
+ * Returns the name of the exclusion window t is in, if any
+ */
+func (s *Scheduler) Excluded(t time.Time) (string, bool) {
+	start := t.Truncate(time.Minute)
+	for _, ew := range s.Exclusions {
+		for m := time.Duration(0); m < ew.Duration; m += time.Minute {
+			if ew.Cron.Matches(start.Add(-m)) {
+				return ew.Name, true
+			}
+		}
+	}
+	return "", false
+}
+
+/*
+ * The next n scheduled switches across all the rules
+ */
+func (s *Scheduler) Upcoming(n int) []ScheduledAction {
+	now := time.Now()
+	actions := []ScheduledAction{}
+	for _, rule := range s.Rules {
+		t := now
+		for i := 0; i < n; i++ {
+			t = rule.Cron.Next(t)
+			if t.IsZero() {
+				break
+			}
+			sa := ScheduledAction{
+				Time:   t,
+				Rule:   rule.Name,
+				Target: rule.Target.String(),
+			}
+			sa.Excluded, _ = s.Excluded(t)
+			actions = append(actions, sa)
+		}
+	}
+	sort.SliceStable(actions, func(i, j int) bool {
+		return actions[i].Time.Before(actions[j].Time)
+	})
+	if len(actions) > n {
+		actions = actions[:n]
+	}
+	return actions
+}
+
+/*
+ * Never returns, so call as a goroutine
+ */
+func (s *Scheduler) Run() {
+	log.Printf("Scheduler running with %d rules and %d exclusion windows", len(s.Rules), len(s.Exclusions))
+	for {
+		// wake up at the top of every minute
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		now = time.Now().Truncate(time.Minute)
+		for _, rule := range s.Rules {
+			if rule.Cron.Matches(now) {
+				s.run(rule, now)
+			}
+		}
+	}
+}
+
+func (s *Scheduler) run(rule *ScheduleRule, now time.Time) {
+	rule.LastRun = now
+	if name, ok := s.Excluded(now); ok {
+		rule.LastResult = fmt.Sprintf("skipped, in exclusion window %s", name)
+		log.Printf("Scheduler: %s %s", rule.Name, rule.LastResult)
+		return
+	}
+	log.Printf("Scheduler: %s switching to %s", rule.Name, rule.Target.String())
+	exit, err := rule.Target.switchTo()
+	if err != nil {
+		rule.LastResult = fmt.Sprintf("failed: %s", err.Error())
+	} else {
+		rule.LastResult = fmt.Sprintf("switched to %s / %s", rule.Target.Vendor, exit)
+		dropTrial("schedule " + rule.Name)
+	}
+	log.Printf("Scheduler: %s %s", rule.Name, rule.LastResult)
+}
+
+/*
+ * Returns the name of the exclusion window we are in if automation is
+ * not allowed to switch right now
+ */
+func automationBlocked() (string, bool) {
+	if GS.Scheduler == nil {
+		return "", false
+	}
+	return GS.Scheduler.Excluded(time.Now())
+}
+
+func (gs GlobalState) UpcomingSwitches() []ScheduledAction {
+	if gs.Scheduler == nil {
+		return []ScheduledAction{}
+	}
+	return gs.Scheduler.Upcoming(5)
+}
+
+/*
+ * AJAX: the schedule rules and upcoming switches
+ */
+func schedule(c echo.Context) error {
+	if GS.Scheduler == nil {
+		return c.String(http.StatusNotFound, "Scheduler is not enabled")
+	}
+	ret := struct {
+		Rules    []*ScheduleRule
+		Upcoming []ScheduledAction
+		Excluded string
+	}{
+		Rules:    GS.Scheduler.Rules,
+		Upcoming: GS.Scheduler.Upcoming(20),
+	}
+	ret.Excluded, _ = GS.Scheduler.Excluded(time.Now())
+	return c.JSONPretty(http.StatusOK, ret, " ")
+}
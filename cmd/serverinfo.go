@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"sort"
+	"strconv"
+
+	"github.com/synfinatic/vpnexiter/vpn"
+)
+
+/*
+ * Instead of a hostname/IP, a server in the `servers` config can be a map:
+ *
+ *   - host: us-nyc.example.net     # required
+ *     name: New York #2            # shown instead of the host
+ *     protocols: [ikev2, wireguard]
+ *     port: 4500
+ *     tags: [p2p, streaming, static-ip]
+ *     coordinates: [40.71, -74.01] # or latitude & longitude
+ *     load: 40                     # % load reported by the vendor
+ *     enabled: false               # listed, but can't be selected
+ *     vars:                        # free form, for the templates
+ *       psk_id: nyc
+ *
+ * The info is kept in ServerMap.Info of the location, by host.
+ */
+var serverInfoKeys = map[string]bool{
+	"host": true, "name": true, "protocols": true, "port": true, "tags": true,
+	"coordinates": true, "latitude": true, "longitude": true, "load": true,
+	"enabled": true, "vars": true,
+}
+
+/*
+ * Parses a server given as a map.  false if it isn't one (ie: a sub-level)
+ */
+func readServerInfo(m map[string]interface{}) (vpn.ServerInfo, bool) {
+	host, ok := m["host"]
+	if !ok {
+		return vpn.ServerInfo{}, false
+	}
+	switch host.(type) {
+	case map[string]interface{}, []interface{}:
+		// a sub-level called host
+		return vpn.ServerInfo{}, false
+	}
+	info := vpn.NewServerInfo(fmt.Sprint(host))
+	for key := range m {
+		if !serverInfoKeys[key] {
+			log.Printf("Warning: ignoring unknown key `%s` of server %s", key, info.Host)
+		}
+	}
+	if name, ok := m["name"]; ok {
+		info.Name = fmt.Sprint(name)
+	}
+	info.Protocols = configStrings(m["protocols"])
+	info.Tags = configStrings(m["tags"])
+	info.Port = int(configFloat(info.Host, "port", m["port"]))
+	info.Load = int(configFloat(info.Host, "load", m["load"]))
+	if coords := configStrings(m["coordinates"]); len(coords) == 2 {
+		info.Latitude = configFloat(info.Host, "coordinates", coords[0])
+		info.Longitude = configFloat(info.Host, "coordinates", coords[1])
+	} else if len(coords) > 0 {
+		log.Printf("Warning: `coordinates` of server %s must be [latitude, longitude]", info.Host)
+	}
+	if _, ok := m["latitude"]; ok {
+		info.Latitude = configFloat(info.Host, "latitude", m["latitude"])
+	}
+	if _, ok := m["longitude"]; ok {
+		info.Longitude = configFloat(info.Host, "longitude", m["longitude"])
+	}
+	if enabled, ok := m["enabled"].(bool); ok {
+		info.Enabled = enabled
+	}
+	if vars, ok := m["vars"].(map[string]interface{}); ok {
+		info.Vars = map[string]string{}
+		for key, value := range vars {
+			info.Vars[key] = fmt.Sprint(value)
+		}
+	}
+	return info, true
+}
+
+/*
+ * A list or a single value as strings
+ */
+func configStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		ret := []string{}
+		for _, item := range v {
+			ret = append(ret, fmt.Sprint(item))
+		}
+		return ret
+	case []string:
+		return v
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
+
+func configFloat(host string, key string, value interface{}) float64 {
+	if value == nil {
+		return 0
+	}
+	f, err := strconv.ParseFloat(fmt.Sprint(value), 64)
+	if err != nil {
+		log.Printf("Warning: invalid `%s` of server %s: %v", key, host, value)
+	}
+	return f
+}
+
+func (sm *ServerMap) setInfo(server string, info vpn.ServerInfo) {
+	sm.mux.Lock()
+	defer sm.mux.Unlock()
+	if sm.Info == nil {
+		sm.Info = map[string]vpn.ServerInfo{}
+	}
+	sm.Info[server] = info
+}
+
+/*
+ * The info of a server in this location.  Servers given as a plain
+ * string only have the Host.
+ */
+func (sm *ServerMap) serverInfo(server string) vpn.ServerInfo {
+	if info, ok := sm.Info[server]; ok {
+		return info
+	}
+	return vpn.NewServerInfo(server)
+}
+
+/*
+ * The info of the server at the exit ID path.  An IP under a hostname
+ * gets the info of the hostname.
+ */
+func exitInfo(vendor string, path []string) vpn.ServerInfo {
+	vc, err := getVendorConfig(vendor)
+	if err != nil || len(path) == 0 {
+		return vpn.NewServerInfo("")
+	}
+	loc := vc.Servers.locationPath(path)
+	node, err := vc.Servers.getNode(loc)
+	if err != nil {
+		return vpn.NewServerInfo(path[len(path)-1])
+	}
+	return node.serverInfo(path[len(loc)])
+}
+
+/*
+ * HTML badges with the tags & load of the server
+ */
+func infoBadges(info vpn.ServerInfo) template.HTML {
+	html := ""
+	tags := append([]string{}, info.Tags...)
+	sort.Strings(tags)
+	for _, tag := range tags {
+		html += fmt.Sprintf(`<span class="tag">%s</span> `, template.HTMLEscapeString(tag))
+	}
+	if info.Load > 0 {
+		html += fmt.Sprintf(`<span class="load">load %d%%</span> `, info.Load)
+	}
+	return template.HTML(html)
+}
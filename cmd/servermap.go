@@ -5,11 +5,13 @@ import (
 	"fmt"
 	"html/template"
 	"log"
+	"net"
 	"sort"
 	"strings"
 	"sync"
 
 	"github.com/MakeNowJust/heredoc"
+	"github.com/synfinatic/vpnexiter/vpn"
 )
 
 /*
@@ -20,16 +22,25 @@ import (
  * LinkKeys is used to inform GenHTML() if we want the keys of the hash
  * to be hyperlinks (normally, just the values in a list are).
  *
+ * Server is set on the node of a resolved hostname, whose List holds its
+ * IPs.  Needed when a level lists servers next to its sub-levels.
+ *
+ * Unavailable holds the servers of a location we can't switch to and Info
+ * the metadata of its servers which were given as a map.
+ *
  * Everything else should be pretty self explainatory!
  */
 type ServerMap struct {
-	mux      sync.Mutex // not really needed!
-	Vendor   string
-	LinkKeys bool
-	Parent   *ServerMap
-	Name     string
-	List     []string
-	Map      map[string]*ServerMap
+	mux         sync.Mutex // not really needed!
+	Vendor      string
+	LinkKeys    bool
+	Server      bool
+	Parent      *ServerMap `json:"-"`
+	Name        string
+	List        []string
+	Map         map[string]*ServerMap
+	Unavailable map[string]ServerStatus   `json:",omitempty"`
+	Info        map[string]vpn.ServerInfo `json:",omitempty"`
 }
 
 func newServerMap(parent *ServerMap, name string, vendor string, linkKeys bool) *ServerMap {
@@ -69,7 +80,30 @@ func (sm *ServerMap) addList(key string, servers []string) {
 	// someday, maybe we'll even be able to use this mutex
 	sm.mux.Lock()
 	defer sm.mux.Unlock()
-	sm.Map[key] = &ServerMap{List: servers}
+	sm.Map[key] = &ServerMap{List: servers, Server: true}
+}
+
+/*
+ * Is the key of our Map a server (or a sub-level)?
+ */
+func (sm *ServerMap) isServer(key string) bool {
+	child, ok := sm.Map[key]
+	return sm.LinkKeys || (ok && child.Server)
+}
+
+/*
+ * Does the node list servers (and so is a location)?
+ */
+func (sm *ServerMap) hasServers() bool {
+	if sm.hasList() || len(sm.Unavailable) > 0 {
+		return true
+	}
+	for key := range sm.getMap() {
+		if sm.isServer(key) {
+			return true
+		}
+	}
+	return false
 }
 
 func (sm *ServerMap) appendList(servers []string) {
@@ -85,7 +119,9 @@ func (sm *ServerMap) addMap(key string, mdata *ServerMap) {
 }
 
 /*
- * returns the first path to the value or returns an error if not found
+ * returns the first path to the value or returns an error if not found.
+ * Keys are searched in sorted order so the same value listed in several
+ * places always gives the same path.
  */
 func FindServerMapEntry(sm *ServerMap, value string) ([]string, error) {
 	log.Printf("Looking for %s in %v\n", value, sm)
@@ -101,7 +137,13 @@ func FindServerMapEntry(sm *ServerMap, value string) ([]string, error) {
 	}
 	if sm.hasMap() {
 		m := sm.getMap()
-		for key, x := range m {
+		keys := []string{}
+		for key := range m {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			x := m[key]
 			// Check if our value is a key in a Map
 			if key == value {
 				return []string{key}, nil
@@ -211,11 +253,15 @@ func (sm *ServerMap) GenHTMLTemplate() (template.HTML, error) {
 	return template.HTML(s), nil
 }
 
-func (sm *ServerMap) mapKeyToLabel(key string) (string, error) {
-	if !sm.LinkKeys || len(sm.Vendor) == 0 {
-		return key, nil
+/*
+ * path is the path of the key, for the exit ID
+ */
+func (sm *ServerMap) mapKeyToLabel(key string, path []string) (string, error) {
+	if !sm.isServer(key) || len(sm.Vendor) == 0 {
+		return template.HTMLEscapeString(key), nil
 	} else {
-		return fmt.Sprintf(`<a href="select_exit/%s/%s">%s</a>`, sm.Vendor, key, key), nil
+		return fmt.Sprintf(`<a href="/select_exit/%s">%s</a>`,
+			exitID(sm.Vendor, path), template.HTMLEscapeString(sm.serverInfo(key).DisplayName())), nil
 	}
 }
 
@@ -223,35 +269,90 @@ func (sm *ServerMap) mapKeyToLabel(key string) (string, error) {
  * Generates a HTML tree representation of a ServerMap
  */
 func (sm *ServerMap) GenHTML(baseurl string, vendor string) (string, error) {
+	return sm.genHTML(baseurl, vendor, []string{})
+}
+
+/*
+ * Labels IP addresses with their family so IPv4 & IPv6 are easy to tell apart
+ */
+func familyBadge(name string) template.HTML {
+	ip := net.ParseIP(name)
+	if ip == nil {
+		return ""
+	} else if ip.To4() != nil {
+		return `<span class="family">IPv4</span> `
+	}
+	return `<span class="family">IPv6</span> `
+}
+
+/*
+ * A location is a leaf in the tree holding the servers for a city.  Selecting
+ * it lets the switch_policy pick the server
+ */
+func (sm *ServerMap) isLocation(parent *ServerMap) bool {
+	return !sm.Server && (sm.LinkKeys || (sm.hasServers() && !parent.LinkKeys))
+}
+
+// helper for GenHTML() which tracks the path to the current node
+func (sm *ServerMap) genHTML(baseurl string, vendor string, path []string) (string, error) {
 	var html bytes.Buffer
 
 	/*
-	 * Mix Sprintf & template because you can't access a top
-	 * level variable (baseurl) from inside a loop (range exits)
-	 * because html.template kinda sucks
+	 * The href (the exit ID of the server) is built here because you
+	 * can't access a top level variable (baseurl) from inside a loop
+	 * (range exits) and names must be escaped one path segment at a time
 	 */
 	listTmpl, _ := template.New("server_list").Parse(
-		fmt.Sprintf(
-			heredoc.Doc(
-				`{{range $name := .}}
-	<li>
-		<div><a href="%s/%s/{{$name}}">{{$name}}</a></div>
-	</li>
+		heredoc.Doc(
+			`{{range .}}
+	{{if .Unavailable}}<li class="ui-state-disabled">
+		<div>{{.Name}} {{.Badge}}</div>
+	{{else}}<li>
+		<div><a href="{{.Href}}">{{.Name}}</a> {{.Badge}}</div>
+	{{end}}</li>
 {{end}}`,
-			),
-			baseurl, vendor),
+		),
 	)
 
-	if sm.hasList() {
-		l := sm.getList()
-		if len(l) > 1 {
-			err := listTmpl.Execute(&html, l)
+	type serverItem struct {
+		Name        string
+		Href        string
+		Badge       template.HTML
+		Unavailable bool
+	}
+	href := func(server string) string {
+		return fmt.Sprintf("%s/%s", baseurl, exitID(vendor, append(append([]string{}, path...), server)))
+	}
+
+	if sm.hasList() || len(sm.Unavailable) > 0 {
+		l := sm.sortByLatency(sm.getList())
+		if len(l) > 1 || len(sm.Unavailable) > 0 {
+			items := []serverItem{}
+			for _, name := range l {
+				info := sm.serverInfo(name)
+				item := serverItem{Name: info.DisplayName(), Href: href(name), Badge: familyBadge(name) + infoBadges(info) + sm.latencyBadge(name)}
+				if ss, bad := sm.serverStatus(name); bad {
+					item.Badge, item.Unavailable = familyBadge(name)+infoBadges(info)+statusBadge(ss), true
+				}
+				items = append(items, item)
+			}
+			// unavailable servers go last, greyed out
+			for _, name := range sm.unavailableServers() {
+				info := sm.serverInfo(name)
+				items = append(items, serverItem{Name: info.DisplayName(), Badge: infoBadges(info) + statusBadge(sm.Unavailable[name]), Unavailable: true})
+			}
+			err := listTmpl.Execute(&html, items)
 			if err != nil {
 				log.Fatal(err.Error())
 			}
+		} else if ss, bad := sm.serverStatus(l[0]); bad {
+			x, info := l[0], sm.serverInfo(l[0])
+			buf := fmt.Sprintf(`%s %s%s%s`, template.HTMLEscapeString(info.DisplayName()), familyBadge(x), infoBadges(info), statusBadge(ss))
+			html.Write([]byte(buf))
 		} else {
-			x := l[0]
-			buf := fmt.Sprintf(`<a href="%s/%s/%s">%s</a>`, baseurl, vendor, x, x)
+			x, info := l[0], sm.serverInfo(l[0])
+			buf := fmt.Sprintf(`<a href="%s">%s</a> %s%s%s`,
+				href(x), template.HTMLEscapeString(info.DisplayName()), familyBadge(x), infoBadges(info), sm.latencyBadge(x))
 			html.Write([]byte(buf))
 		}
 	}
@@ -263,15 +364,35 @@ func (sm *ServerMap) GenHTML(baseurl string, vendor string) (string, error) {
 			mapkeys = append(mapkeys, key)
 		}
 		sort.Strings(mapkeys)
+		if sm.LinkKeys {
+			// keys are servers
+			mapkeys = sm.sortByLatency(mapkeys)
+		}
 		for _, key := range mapkeys {
 			value := m[key]
-			label, err := sm.mapKeyToLabel(key)
+			keyPath := append(append([]string{}, path...), key)
+			label, err := sm.mapKeyToLabel(key, keyPath)
 			if err != nil {
 				log.Fatal(err.Error())
 			}
-			header := fmt.Sprintf("<li><div>%s</div><ul>", label)
+			class := ""
+			if !sm.isServer(key) && value.isLocation(sm) {
+				label = fmt.Sprintf(`<a href="/select_location/%s">%s</a>`,
+					escapePath(append([]string{vendor}, keyPath...)...), template.HTMLEscapeString(key))
+			} else if !sm.isServer(key) {
+				label = fmt.Sprintf(`%s <a href="/auto_select/%s">(auto)</a>`,
+					template.HTMLEscapeString(key), escapePath(append([]string{vendor}, keyPath...)...))
+			} else if ss, bad := sm.serverStatus(key); bad {
+				// greyed out, so no link
+				info := sm.serverInfo(key)
+				label = fmt.Sprintf("%s %s%s", template.HTMLEscapeString(info.DisplayName()), infoBadges(info), statusBadge(ss))
+				class = ` class="ui-state-disabled"`
+			} else {
+				label = fmt.Sprintf("%s %s%s", label, infoBadges(sm.serverInfo(key)), sm.latencyBadge(key))
+			}
+			header := fmt.Sprintf("<li%s><div>%s</div><ul>", class, label)
 			html.Write([]byte(header))
-			body, err := value.GenHTML(baseurl, sm.Vendor)
+			body, err := value.genHTML(baseurl, sm.Vendor, keyPath)
 			if err != nil {
 				log.Fatal(err.Error())
 			}
@@ -281,3 +402,84 @@ func (sm *ServerMap) GenHTML(baseurl string, vendor string) (string, error) {
 	}
 	return html.String(), nil
 }
+
+/*
+ * JSON friendly version of a ServerMap (which has a Parent pointer) used
+ * by the `/tree/:vendor` AJAX call.  Servers are sorted by latency.
+ */
+type ServerTree struct {
+	Name     string
+	Location bool          // selecting it uses the switch_policy
+	Servers  []ServerLeaf  `json:",omitempty"`
+	Children []*ServerTree `json:",omitempty"`
+}
+
+type ServerLeaf struct {
+	Name    string
+	ID      string          // exit ID
+	IPs     []string        `json:",omitempty"`
+	IPv4    []string        `json:",omitempty"`
+	IPv6    []string        `json:",omitempty"`
+	Latency *LatencySummary `json:",omitempty"`
+	Status  *ServerStatus   `json:",omitempty"` // set if it can't be selected
+	Info    *vpn.ServerInfo `json:",omitempty"` // set if given as a map in the config
+}
+
+func (sm *ServerMap) Tree(name string, location bool) *ServerTree {
+	return sm.tree(name, location, []string{})
+}
+
+// helper for Tree() which tracks the path to the current node
+func (sm *ServerMap) tree(name string, location bool, path []string) *ServerTree {
+	id := func(server string) string {
+		return exitID(sm.Vendor, append(append([]string{}, path...), server))
+	}
+	st := &ServerTree{
+		Name:     name,
+		Location: location,
+		Servers:  []ServerLeaf{},
+		Children: []*ServerTree{},
+	}
+	for _, server := range sm.sortByLatency(sm.locationServers()) {
+		leaf := ServerLeaf{Name: server, ID: id(server)}
+		if child, ok := sm.getMap()[server]; ok {
+			leaf.IPs = child.getList()
+			leaf.IPv4, leaf.IPv6 = vpn.SplitFamilies(leaf.IPs)
+		}
+		if ls, ok := sm.latencyOf(server); ok {
+			leaf.Latency = &ls
+		}
+		if ss, bad := sm.serverStatus(server); bad {
+			leaf.Status = &ss
+		}
+		if info, ok := sm.Info[server]; ok {
+			leaf.Info = &info
+		}
+		st.Servers = append(st.Servers, leaf)
+	}
+	for _, server := range sm.unavailableServers() {
+		leaf := ServerLeaf{Name: server, ID: id(server)}
+		ss := sm.Unavailable[server]
+		leaf.Status = &ss
+		if info, ok := sm.Info[server]; ok {
+			leaf.Info = &info
+		}
+		st.Servers = append(st.Servers, leaf)
+	}
+	if sm.LinkKeys {
+		return st
+	}
+
+	keys := []string{}
+	for key := range sm.getMap() {
+		if !sm.isServer(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		child := sm.getMap()[key]
+		st.Children = append(st.Children, child.tree(key, child.isLocation(sm), append(append([]string{}, path...), key)))
+	}
+	return st
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"sort"
+	"strings"
+)
+
+/*
+ * Servers we can't switch to stay in the ServerMap (so they still show up
+ * greyed out with the reason) instead of vanishing from the menu:
+ *
+ * unresolvable:  the hostname didn't resolve when the vendor was loaded
+ * probe_failing: the latency_prober gets no replies from any of its IPs
+ * disabled:      listed in `<vendor>.disabled_servers`
+ *
+ * Unresolvable & disabled servers are kept in ServerMap.Unavailable of
+ * their location.  Probe failures change all the time so are looked up
+ * in the LatencyTable when needed.
+ */
+const (
+	StatusUnresolvable = "unresolvable"
+	StatusProbeFailing = "probe_failing"
+	StatusDisabled     = "disabled"
+)
+
+type ServerStatus struct {
+	Status    string
+	LastError string
+}
+
+func (ss ServerStatus) String() string {
+	if len(ss.LastError) == 0 {
+		return ss.Status
+	}
+	return fmt.Sprintf("%s: %s", ss.Status, ss.LastError)
+}
+
+func disabledServer(vendor string, server string) bool {
+	for _, s := range Konf.Strings(vendor + ".disabled_servers") {
+		if s == server {
+			return true
+		}
+	}
+	return false
+}
+
+func (sm *ServerMap) markUnavailable(server string, ss ServerStatus) {
+	sm.mux.Lock()
+	defer sm.mux.Unlock()
+	if sm.Unavailable == nil {
+		sm.Unavailable = map[string]ServerStatus{}
+	}
+	sm.Unavailable[server] = ss
+}
+
+/*
+ * Unavailable servers of the location, sorted
+ */
+func (sm *ServerMap) unavailableServers() []string {
+	names := []string{}
+	for name := range sm.Unavailable {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+ * Why the server in this location can't be used.  false if it can be.
+ */
+func (sm *ServerMap) serverStatus(server string) (ServerStatus, bool) {
+	if ss, ok := sm.Unavailable[server]; ok {
+		return ss, true
+	}
+	if ls, ok := sm.latencyOf(server); ok && ls.down() {
+		return ServerStatus{
+			Status:    StatusProbeFailing,
+			LastError: fmt.Sprintf("no replies to the last %d probes", ls.Samples),
+		}, true
+	}
+	return ServerStatus{}, false
+}
+
+/*
+ * Drops the servers we can't use
+ */
+func (sm *ServerMap) usableServers(servers []string) []string {
+	usable := []string{}
+	for _, server := range servers {
+		if _, bad := sm.serverStatus(server); !bad {
+			usable = append(usable, server)
+		}
+	}
+	return usable
+}
+
+/*
+ * Returns the path to the unavailable server
+ */
+func findUnavailable(sm *ServerMap, server string) ([]string, ServerStatus, bool) {
+	if ss, ok := sm.Unavailable[server]; ok {
+		return []string{server}, ss, true
+	}
+	for key, child := range sm.getMap() {
+		if path, ss, ok := findUnavailable(child, server); ok {
+			return append([]string{key}, path...), ss, true
+		}
+	}
+	return nil, ServerStatus{}, false
+}
+
+/*
+ * Like FindServerMapEntry(), but explains why an unavailable server can't
+ * be selected
+ */
+func findServer(sm *ServerMap, server string) ([]string, error) {
+	path, err := FindServerMapEntry(sm, server)
+	if err == nil {
+		return path, nil
+	}
+	if loc, ss, ok := findUnavailable(sm, server); ok {
+		return nil, fmt.Errorf("Refusing to switch to %s in %s: %s",
+			server, strings.Join(loc[:len(loc)-1], " / "), ss.String())
+	}
+	return nil, err
+}
+
+/*
+ * Returns an error if the server at path can't be used
+ */
+func serverUsable(vendor string, exit string, path []string) error {
+	vc, err := getVendorConfig(vendor)
+	if err != nil {
+		return err
+	}
+	if len(path) == 0 {
+		return nil
+	}
+	node, err := vc.Servers.getNode(vc.Servers.locationPath(path))
+	if err != nil {
+		// not in the tree, so nothing is known about it
+		return nil
+	}
+	if ss, bad := node.serverStatus(exit); bad {
+		return fmt.Errorf("Refusing to switch to %s: %s", exit, ss.String())
+	}
+	return nil
+}
+
+/*
+ * HTML badge with the reason the server can't be used
+ */
+func statusBadge(ss ServerStatus) template.HTML {
+	return template.HTML(fmt.Sprintf(`<span class="unavailable">%s</span>`, template.HTMLEscapeString(ss.String())))
+}
@@ -121,9 +121,86 @@ func runSpeedtest(c echo.Context) (SpeedtestResults, error) {
 		ResultURL:         result["url"].(string),
 	}
 
+	recordSpeedtest(SR)
 	return SR, nil
 }
 
+/*
+ * What we remember about past speedtests so auto-select can prefer
+ * exits which have been fast
+ */
+type SpeedtestRecord struct {
+	Vendor       string
+	Exit         string
+	ExitID       string `json:",omitempty"`
+	Timestamp    string
+	LatencyMs    float64
+	DownloadMbps float64
+	UploadMbps   float64
+}
+
+const maxSpeedtestRecords = 500
+
+func recordSpeedtest(SR SpeedtestResults) {
+	rec := SpeedtestRecord{
+		Vendor:       SR.Vendor,
+		Exit:         SR.Exit,
+		Timestamp:    SR.Timestamp,
+		LatencyMs:    SR.PingLatency,
+		DownloadMbps: SR.DownloadBandwidth * 8 / (1000 * 1000),
+		UploadMbps:   SR.UploadBandwidth * 8 / (1000 * 1000),
+	}
+	if len(SR.ExitPath) > 0 {
+		rec.ExitID = escapePath(SR.ExitPath...)
+	}
+	psMux.Lock()
+	PS.Speedtests = append(PS.Speedtests, rec)
+	if len(PS.Speedtests) > maxSpeedtestRecords {
+		PS.Speedtests = PS.Speedtests[len(PS.Speedtests)-maxSpeedtestRecords:]
+	}
+	psMux.Unlock()
+	saveState()
+}
+
+/*
+ * Average download & upload Mbps of past speedtests for the exit ID.
+ * Results recorded without an exit ID fall back to matching the vendor
+ * and any of the given exit names.  ok is false if we have no results.
+ */
+func speedtestAverage(vendor, id string, exits []string) (float64, float64, bool) {
+	psMux.Lock()
+	defer psMux.Unlock()
+	var down, up float64
+	count := 0
+	for _, rec := range PS.Speedtests {
+		if !rec.matches(vendor, id, exits) {
+			continue
+		}
+		down += rec.DownloadMbps
+		up += rec.UploadMbps
+		count++
+	}
+	if count == 0 {
+		return 0, 0, false
+	}
+	return down / float64(count), up / float64(count), true
+}
+
+func (rec SpeedtestRecord) matches(vendor, id string, exits []string) bool {
+	if len(rec.ExitID) > 0 {
+		return rec.ExitID == id
+	}
+	if rec.Vendor != vendor {
+		return false
+	}
+	for _, exit := range exits {
+		if rec.Exit == exit {
+			return true
+		}
+	}
+	return false
+}
+
 func Speedtest(c echo.Context) error {
 	mode := c.Param("mode")
 	// If we don't have a speedtest_url set, use the speedtest_cli
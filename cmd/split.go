@@ -0,0 +1,562 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+/*
+ * Destination based split tunneling: traffic to the domains & CIDRs in a
+ * list goes `Via` the main tunnel (`default`), the WAN (`direct`) or
+ * another exit (via a policy routing tunnel).
+ *
+ * dnsmasq adds the addresses it resolves for the domains to a nftables
+ * set (or ipset), packets to the set are marked and an `ip rule` sends
+ * the mark to the routing table of the exit.
+ */
+type SplitList struct {
+	Name    string
+	Via     ClientTarget
+	Domains []string
+	CIDRs   []string
+}
+
+// A list as rendered in the dnsmasq & firewall templates
+type SplitListRule struct {
+	SplitList
+	Set4  string
+	Set6  string
+	Mark  int
+	Table string
+	CIDR4 []string
+	CIDR6 []string
+	// CIDRs as a nftables set
+	Elements4 string
+	Elements6 string
+}
+
+type SplitTemplate struct {
+	Lists     []SplitListRule
+	RulesFile string
+	SetsFile  string
+}
+
+type splitBackend struct {
+	Dnsmasq string
+	Rules   string
+	Sets    string
+	Setup   []string
+	Enable  []string
+}
+
+var splitBackends = map[string]splitBackend{
+	"nftables": {
+		Dnsmasq: `{{- range .Lists }}{{ $l := . }}{{ range .Domains }}
+nftset=/{{ . }}/4#inet#vpnexiter_split#{{ $l.Set4 }},6#inet#vpnexiter_split#{{ $l.Set6 }}
+{{- end }}{{ end }}
+`,
+		Rules: `table inet vpnexiter_split {}
+delete table inet vpnexiter_split
+table inet vpnexiter_split {
+{{- range .Lists }}
+	set {{ .Set4 }} {
+		type ipv4_addr; flags interval;
+		{{- if .CIDR4 }}
+		elements = { {{ .Elements4 }} }
+		{{- end }}
+	}
+	set {{ .Set6 }} {
+		type ipv6_addr; flags interval;
+		{{- if .CIDR6 }}
+		elements = { {{ .Elements6 }} }
+		{{- end }}
+	}
+{{- end }}
+	chain prerouting {
+		type filter hook prerouting priority -150; policy accept;
+{{- range .Lists }}
+		ip daddr @{{ .Set4 }} meta mark set {{ .Mark }}
+		ip6 daddr @{{ .Set6 }} meta mark set {{ .Mark }}
+{{- end }}
+	}
+}
+`,
+		Setup:  []string{},
+		Enable: []string{"nft -f {{.RulesFile}}"},
+	},
+	// IPv4 only
+	"iptables": {
+		Dnsmasq: `{{- range .Lists }}{{ $l := . }}{{ range .Domains }}
+ipset=/{{ . }}/{{ $l.Set4 }}
+{{- end }}{{ end }}
+`,
+		Sets: `{{- range .Lists }}{{ $l := . }}
+create {{ .Set4 }} hash:net family inet
+flush {{ .Set4 }}
+{{- range .CIDR4 }}
+add {{ $l.Set4 }} {{ . }}
+{{- end }}
+{{- end }}
+`,
+		Rules: `*mangle
+:VPNEXITER_SPLIT - [0:0]
+-I PREROUTING -j VPNEXITER_SPLIT
+{{- range .Lists }}
+-A VPNEXITER_SPLIT -m set --match-set {{ .Set4 }} dst -j MARK --set-mark {{ .Mark }}
+{{- end }}
+COMMIT
+`,
+		Setup:  []string{"iptables -t mangle -D PREROUTING -j VPNEXITER_SPLIT"},
+		Enable: []string{"ipset -exist restore -file {{.SetsFile}}", "iptables-restore -n {{.RulesFile}}"},
+	},
+}
+
+var splitNameRe = regexp.MustCompile(`[^a-z0-9_]`)
+
+// one or more dot separated hostname labels
+var splitDomainRe = regexp.MustCompile(`^([a-z0-9_]([a-z0-9_-]{0,61}[a-z0-9])?\.)*[a-z0-9_]([a-z0-9_-]{0,61}[a-z0-9])?$`)
+
+/*
+ * Domains end up in the dnsmasq config, so anything which isn't a plain
+ * hostname (ie: `/` or `#`) could inject options
+ */
+func validDomain(domain string) bool {
+	return len(domain) <= 253 && splitDomainRe.MatchString(domain)
+}
+
+/*
+ * Where a list can send its traffic
+ */
+func splitViaTargets() []ClientTarget {
+	if GS.PolicyRouting != nil {
+		return GS.PolicyRouting.Targets()
+	}
+	return []ClientTarget{TargetDefault, TargetDirect}
+}
+
+func validVia(via ClientTarget) bool {
+	for _, target := range splitViaTargets() {
+		if via == target {
+			return true
+		}
+	}
+	return false
+}
+
+type SplitTunnel struct {
+	LastError   string
+	LastApplied time.Time
+	mux         sync.Mutex
+}
+
+/*
+ * The lists from `split_tunnel.lists` in the config
+ */
+func configSplitLists() map[string]SplitList {
+	lists := map[string]SplitList{}
+	for _, k := range Konf.Slices("split_tunnel.lists") {
+		sl := SplitList{
+			Name:    k.String("name"),
+			Via:     ClientTarget(k.String("via")),
+			Domains: k.Strings("domains"),
+			CIDRs:   k.Strings("cidrs"),
+		}
+		if len(k.String("id")) > 0 {
+			sl.Via = ClientTarget(k.String("id"))
+		} else if len(k.String("exit")) > 0 {
+			sl.Via = ClientTarget(exitID(k.String("vendor"), []string{k.String("exit")}))
+		}
+		lists[sl.Name] = sl
+	}
+	return lists
+}
+
+/*
+ * The lists from the config plus the ones saved on the Split Tunnel tab
+ * (in the state_file), which replace config lists of the same name
+ */
+func splitLists() []SplitList {
+	merged := configSplitLists()
+	psMux.Lock()
+	for name, sl := range PS.SplitLists {
+		merged[name] = sl
+	}
+	psMux.Unlock()
+	lists := []SplitList{}
+	for _, sl := range merged {
+		lists = append(lists, sl)
+	}
+	sort.Slice(lists, func(i, j int) bool { return lists[i].Name < lists[j].Name })
+	return lists
+}
+
+/*
+ * Exits the lists need, so policy routing doesn't reuse their tunnels
+ */
+func splitTargets() []ClientTarget {
+	targets := []ClientTarget{}
+	if GS.SplitTunnel == nil {
+		return targets
+	}
+	for _, sl := range splitLists() {
+		targets = append(targets, sl.Via)
+	}
+	return targets
+}
+
+func (st *SplitTunnel) backend() (splitBackend, error) {
+	name := Konf.String("split_tunnel.backend")
+	if len(name) == 0 {
+		name = "nftables"
+	}
+	backend, ok := splitBackends[name]
+	if !ok {
+		return backend, fmt.Errorf("Unknown split_tunnel.backend %s", name)
+	}
+	for key, tmpl := range map[string]*string{
+		"split_tunnel.dnsmasq_template": &backend.Dnsmasq,
+		"split_tunnel.rules_template":   &backend.Rules,
+		"split_tunnel.sets_template":    &backend.Sets,
+	} {
+		if fname := Konf.String(key); len(fname) > 0 {
+			data, err := ioutil.ReadFile(fname)
+			if err != nil {
+				return backend, err
+			}
+			*tmpl = string(data)
+		}
+	}
+	return backend, nil
+}
+
+func splitFile(key string, def string) string {
+	if len(Konf.String(key)) > 0 {
+		return Konf.String(key)
+	}
+	return def
+}
+
+/*
+ * Brings up policy routing tunnels for any lists which go via another exit.
+ * switchTunnel() takes switchMux, so never call this with st.mux held.
+ */
+func (st *SplitTunnel) bringUpTunnels() {
+	if GS.PolicyRouting == nil {
+		return
+	}
+	for _, sl := range splitLists() {
+		vendor, path, ok := sl.Via.exit()
+		if !ok {
+			continue
+		}
+		if _, up := GS.PolicyRouting.tunnelFor(vendor, path); up {
+			continue
+		}
+		t := GS.PolicyRouting.freeTunnel("")
+		if t == nil {
+			log.Printf("Split tunnel: no free tunnel for %s via %s, skipping", sl.Name, sl.Via)
+			continue
+		}
+		if err := GS.PolicyRouting.switchTunnel(t, vendor, path); err != nil {
+			log.Printf("Split tunnel: unable to bring up %s for %s: %s", sl.Via, sl.Name, err.Error())
+		}
+	}
+}
+
+/*
+ * Builds the template data.  Lists which go via another exit need its
+ * policy routing tunnel to be up already.
+ */
+func (st *SplitTunnel) rules() []SplitListRule {
+	baseMark := 0x1000
+	if Konf.Int("split_tunnel.base_mark") > 0 {
+		baseMark = Konf.Int("split_tunnel.base_mark")
+	}
+	directTable := splitFile("split_tunnel.direct_table", "main")
+	defaultTable := splitFile("split_tunnel.default_table", "main")
+
+	rules := []SplitListRule{}
+	for i, sl := range splitLists() {
+		domains := []string{}
+		for _, domain := range sl.Domains {
+			if !validDomain(domain) {
+				log.Printf("Split tunnel: ignoring invalid domain %s in %s", domain, sl.Name)
+				continue
+			}
+			domains = append(domains, domain)
+		}
+		sl.Domains = domains
+		name := splitNameRe.ReplaceAllString(strings.ToLower(sl.Name), "_")
+		rule := SplitListRule{
+			SplitList: sl,
+			Set4:      fmt.Sprintf("split_%s4", name),
+			Set6:      fmt.Sprintf("split_%s6", name),
+			Mark:      baseMark + i,
+			CIDR4:     []string{},
+			CIDR6:     []string{},
+		}
+		for _, cidr := range sl.CIDRs {
+			ip, _, err := net.ParseCIDR(cidr)
+			if err != nil {
+				if ip = net.ParseIP(cidr); ip == nil {
+					log.Printf("Split tunnel: ignoring invalid CIDR %s in %s", cidr, sl.Name)
+					continue
+				}
+			}
+			if ip.To4() != nil {
+				rule.CIDR4 = append(rule.CIDR4, cidr)
+			} else {
+				rule.CIDR6 = append(rule.CIDR6, cidr)
+			}
+		}
+		rule.Elements4 = strings.Join(rule.CIDR4, ", ")
+		rule.Elements6 = strings.Join(rule.CIDR6, ", ")
+
+		switch sl.Via {
+		case TargetDirect:
+			rule.Table = directTable
+		case TargetDefault, "":
+			rule.Table = defaultTable
+		default:
+			vendor, path, ok := sl.Via.exit()
+			if !ok || GS.PolicyRouting == nil {
+				log.Printf("Split tunnel: %s via %s needs policy_routing tunnels, skipping", sl.Name, sl.Via)
+				continue
+			}
+			t, up := GS.PolicyRouting.tunnelFor(vendor, path)
+			if !up {
+				log.Printf("Split tunnel: %s via %s is not up, skipping", sl.Name, sl.Via)
+				continue
+			}
+			rule.Table = defaultTable
+			if t != nil {
+				rule.Table = t.Table
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+/*
+ * Deploys the dnsmasq config & firewall rules and points the marks at the
+ * right routing tables.  Called whenever a list changes.
+ */
+func (st *SplitTunnel) Apply() error {
+	st.bringUpTunnels()
+	return st.deploy()
+}
+
+/*
+ * Called by trySwitchChain() (with switchMux held) once the new exit is
+ * up, so the lists follow the switch before it returns.  Tunnels can't be
+ * switched from here, so lists via an exit which isn't up are skipped.
+ */
+func (st *SplitTunnel) ApplySwitch() error {
+	return st.deploy()
+}
+
+func (st *SplitTunnel) deploy() error {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+	err := st.apply()
+	st.LastApplied = time.Now()
+	st.LastError = ""
+	if err != nil {
+		st.LastError = err.Error()
+		log.Printf("Split tunnel: %s", st.LastError)
+	}
+	return err
+}
+
+func (st *SplitTunnel) apply() error {
+	backend, err := st.backend()
+	if err != nil {
+		return err
+	}
+	data := SplitTemplate{
+		Lists:     st.rules(),
+		RulesFile: splitFile("split_tunnel.rules_file", "/tmp/vpnexiter-split.rules"),
+		SetsFile:  splitFile("split_tunnel.sets_file", "/tmp/vpnexiter-split.sets"),
+	}
+	dnsmasqFile := splitFile("split_tunnel.dnsmasq_file", "/etc/dnsmasq.d/vpnexiter-split.conf")
+
+	if err = GS.VPN.DeployTemplate("split_tunnel.dnsmasq", backend.Dnsmasq, data, dnsmasqFile); err != nil {
+		return err
+	}
+	if err = GS.VPN.DeployTemplate("split_tunnel.rules", backend.Rules, data, data.RulesFile); err != nil {
+		return err
+	}
+	if len(backend.Sets) > 0 {
+		if err = GS.VPN.DeployTemplate("split_tunnel.sets", backend.Sets, data, data.SetsFile); err != nil {
+			return err
+		}
+	}
+	for _, cmd := range GS.VPN.CommandsOr("split_tunnel.setup_command", backend.Setup...) {
+		if _, err := GS.VPN.RunTemplates("split_tunnel.setup_command", []string{cmd}, data); err != nil {
+			log.Printf("Ignoring split tunnel setup error: %s", err.Error())
+		}
+	}
+	if _, err = GS.VPN.RunTemplates("split_tunnel.enable_command", GS.VPN.CommandsOr("split_tunnel.enable_command", backend.Enable...), data); err != nil {
+		return err
+	}
+
+	// replace our fwmark rules
+	basePriority := 900
+	if Konf.Int("split_tunnel.base_priority") > 0 {
+		basePriority = Konf.Int("split_tunnel.base_priority")
+	}
+	psMux.Lock()
+	installed := PS.SplitRules
+	psMux.Unlock()
+	delCmds := GS.VPN.CommandsOr("split_tunnel.del_rule_command", "ip {{if .IPv6}}-6 {{end}}rule del priority {{.Priority}}")
+	for _, rule := range installed {
+		// the rule may already be gone, ie: router reboot
+		GS.VPN.RunTemplates("split_tunnel.del_rule_command", delCmds, rule)
+	}
+	addCmds := GS.VPN.CommandsOr("split_tunnel.add_rule_command", "ip {{if .IPv6}}-6 {{end}}rule add fwmark {{.Source}} lookup {{.Table}} priority {{.Priority}}")
+	installed = []PolicyRule{}
+	failed := []string{}
+	for i, l := range data.Lists {
+		for _, v6 := range []bool{false, true} {
+			rule := PolicyRule{Source: fmt.Sprintf("%d", l.Mark), IPv6: v6, Table: l.Table, Priority: basePriority + i}
+			if _, err := GS.VPN.RunTemplates("split_tunnel.add_rule_command", addCmds, rule); err != nil {
+				// keep going so the other lists still work
+				failed = append(failed, fmt.Sprintf("%s (IPv6: %v): %s", l.Name, v6, err.Error()))
+				continue
+			}
+			installed = append(installed, rule)
+		}
+	}
+	psMux.Lock()
+	PS.SplitRules = installed
+	psMux.Unlock()
+	saveState()
+
+	reload := GS.VPN.CommandsOr("split_tunnel.reload_command", "/etc/init.d/dnsmasq restart")
+	if _, err = GS.VPN.RunTemplates("split_tunnel.reload_command", reload, data); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Unable to add the rules for %s", strings.Join(failed, ", "))
+	}
+	log.Printf("Split tunnel: applied %d lists", len(data.Lists))
+	return nil
+}
+
+/*
+ * Never returns, so call as a goroutine.  Applies the lists once the
+ * vendors are loaded.
+ */
+func (st *SplitTunnel) Start() {
+	for GS.Vendors == nil {
+		time.Sleep(time.Second)
+	}
+	// older versions saved a copy of the config lists
+	config := configSplitLists()
+	psMux.Lock()
+	for name, sl := range PS.SplitLists {
+		if reflect.DeepEqual(sl, config[name]) {
+			delete(PS.SplitLists, name)
+		}
+	}
+	psMux.Unlock()
+	st.Apply()
+}
+
+/*
+ * UI: the Split Tunnel tab
+ */
+func SplitTunnelLists(c echo.Context) error {
+	if GS.SplitTunnel == nil {
+		return c.Render(http.StatusOK, "error.html", "Split tunneling is not enabled")
+	}
+	return c.Render(http.StatusOK, "split_tunnel.html", map[string]interface{}{
+		"Lists":       splitLists(),
+		"Targets":     splitViaTargets(),
+		"SplitTunnel": GS.SplitTunnel,
+	})
+}
+
+/*
+ * UI: POST /split_tunnel with name, via, domains & cidrs (one per line)
+ * creates or replaces a list.  An empty list is deleted.
+ */
+func SplitTunnelSave(c echo.Context) error {
+	if GS.SplitTunnel == nil {
+		return c.Render(http.StatusOK, "error.html", "Split tunneling is not enabled")
+	}
+	sl := SplitList{
+		Name:    strings.TrimSpace(c.FormValue("name")),
+		Via:     ClientTarget(c.FormValue("via")),
+		Domains: strings.Fields(strings.ToLower(c.FormValue("domains"))),
+		CIDRs:   strings.Fields(c.FormValue("cidrs")),
+	}
+	if len(sl.Name) == 0 {
+		return c.Render(http.StatusOK, "error.html", "Missing list name")
+	}
+	if len(sl.Via) == 0 {
+		sl.Via = TargetDefault
+	}
+	if !validVia(sl.Via) {
+		return c.Render(http.StatusOK, "error.html", fmt.Sprintf("Invalid via: %s", sl.Via))
+	}
+	for i, domain := range sl.Domains {
+		sl.Domains[i] = strings.TrimSuffix(domain, ".")
+		if !validDomain(sl.Domains[i]) {
+			return c.Render(http.StatusOK, "error.html", fmt.Sprintf("Invalid domain: %s", domain))
+		}
+	}
+	for _, cidr := range sl.CIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil && net.ParseIP(cidr) == nil {
+			return c.Render(http.StatusOK, "error.html", fmt.Sprintf("Invalid CIDR: %s", cidr))
+		}
+	}
+	config, inConfig := configSplitLists()[sl.Name]
+	empty := len(sl.Domains) == 0 && len(sl.CIDRs) == 0
+	if empty && inConfig {
+		return c.Render(http.StatusOK, "error.html",
+			fmt.Sprintf("%s is in the config file, remove it from `split_tunnel.lists` to delete it", sl.Name))
+	}
+	psMux.Lock()
+	if PS.SplitLists == nil {
+		PS.SplitLists = map[string]SplitList{}
+	}
+	if empty || (inConfig && reflect.DeepEqual(sl, config)) {
+		// deleted or back to what the config says
+		delete(PS.SplitLists, sl.Name)
+	} else {
+		PS.SplitLists[sl.Name] = sl
+	}
+	psMux.Unlock()
+	saveState()
+	if err := GS.SplitTunnel.Apply(); err != nil {
+		return c.Render(http.StatusOK, "error.html", err.Error())
+	}
+	return c.Redirect(http.StatusSeeOther, "/#split-tunnel")
+}
+
+/*
+ * AJAX: the split tunnel lists
+ */
+func splitTunnel(c echo.Context) error {
+	if GS.SplitTunnel == nil {
+		return c.String(http.StatusNotFound, "Split tunneling is not enabled")
+	}
+	return c.JSONPretty(http.StatusOK, map[string]interface{}{
+		"Lists":       splitLists(),
+		"LastApplied": GS.SplitTunnel.LastApplied,
+		"LastError":   GS.SplitTunnel.LastError,
+	}, " ")
+}
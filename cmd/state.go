@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+)
+
+/*
+ * Runtime state which needs to survive a restart of vpnexiter.  Stored as
+ * JSON in `state_file`
+ */
+type PersistentState struct {
+	Trial       *TrialSwitch `json:",omitempty"`
+	Speedtests  []SpeedtestRecord
+	Rotation    RotationState
+	Tunnels     map[string]TunnelState
+	Clients     map[string]ClientTarget
+	PolicyRules []PolicyRule // rules we installed on the router
+	SplitLists  map[string]SplitList
+	SplitRules  []PolicyRule
+	// the kill switch was lifted by an admin
+	KillSwitchLifted bool `json:",omitempty"`
+}
+
+var PS = PersistentState{}
+var psMux sync.Mutex
+
+func loadState() {
+	fname := Konf.String("state_file")
+	if len(fname) == 0 || !fileExists(fname) {
+		return
+	}
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		log.Printf("Unable to read state_file %s: %s", fname, err.Error())
+		return
+	}
+	psMux.Lock()
+	defer psMux.Unlock()
+	if err = json.Unmarshal(data, &PS); err != nil {
+		log.Printf("Unable to parse state_file %s: %s", fname, err.Error())
+	}
+	for i, id := range PS.Rotation.Recent {
+		PS.Rotation.Recent[i] = migrateExitID(id)
+	}
+}
+
+func saveState() {
+	fname := Konf.String("state_file")
+	if len(fname) == 0 {
+		return
+	}
+	psMux.Lock()
+	data, err := json.MarshalIndent(&PS, "", "  ")
+	psMux.Unlock()
+	if err != nil {
+		log.Printf("Unable to save state: %s", err.Error())
+		return
+	}
+	// write & rename so we never leave a truncated file behind
+	tmp := fname + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("Unable to write state_file %s: %s", tmp, err.Error())
+		return
+	}
+	if err = os.Rename(tmp, fname); err != nil {
+		log.Printf("Unable to write state_file %s: %s", fname, err.Error())
+	}
+}
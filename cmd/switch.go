@@ -0,0 +1,425 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/knadh/koanf"
+	"github.com/synfinatic/vpnexiter/vpn"
+	"gopkg.in/grignaak/tribool.v1"
+)
+
+/*
+ * Every exit change goes through here so that they all behave the same
+ * and only one switch can happen at a time.
+ */
+var switchMux sync.Mutex
+
+/*
+ * Controls how hard we try before giving up on a location
+ *
+ * Retries:  attempts per server before moving on
+ * Backoff:  sleep after the first failed attempt, doubles each retry
+ * Fallback: ordered | random | none - how to pick sibling servers
+ */
+type SwitchPolicy struct {
+	Retries  int
+	Backoff  time.Duration
+	Fallback string
+}
+
+func getSwitchPolicy() SwitchPolicy {
+	sp := SwitchPolicy{
+		Retries:  1,
+		Backoff:  2 * time.Second,
+		Fallback: "ordered",
+	}
+	if Konf.Int("switch_policy.retries") > 0 {
+		sp.Retries = Konf.Int("switch_policy.retries")
+	}
+	if Konf.Exists("switch_policy.backoff_seconds") {
+		sp.Backoff = time.Duration(Konf.Int("switch_policy.backoff_seconds")) * time.Second
+	}
+	switch f := Konf.String("switch_policy.fallback"); f {
+	case "":
+	case "ordered", "random", "none":
+		sp.Fallback = f
+	default:
+		log.Printf("Warning: unknown `switch_policy.fallback` %s, using %s", f, sp.Fallback)
+	}
+	return sp
+}
+
+/*
+ * Try to switch to the given vendor/exit exactly once and update GS
+ */
+func trySwitch(vendor string, exit string, path []string) error {
+	return trySwitchChain("", []ChainHop{{Vendor: vendor, Exit: exit, Path: path}})
+}
+
+/*
+ * Try to switch to the hops (outer first) exactly once and update GS.
+ * A single hop is a regular exit.
+ */
+func trySwitchChain(chain string, hops []ChainHop) error {
+	prevVendor, prevExit, prevPath, prevIPs := GS.Vendor, GS.Exit, GS.ExitPath, GS.ExitIPs
+	prevChain, prevHops := GS.Chain, GS.Hops
+	egress := hops[len(hops)-1]
+	vendor, exit, path := egress.Vendor, egress.Exit, egress.Path
+
+	for _, hop := range hops {
+		if err := preflightCheck(hop.Vendor, hop.Exit, hop.Path); err != nil {
+			return err
+		}
+	}
+	defer liftForSwitch()()
+
+	saved := GS.VPN.Snapshot()
+	var err error
+	if len(hops) > 1 {
+		err = GS.VPN.UpdateChain(vpnHops(hops))
+	} else {
+		err = GS.VPN.UpdateConfig(vendor, exit, exitInfo(vendor, path))
+	}
+	if err != nil {
+		// the VPN was left alone, so we are still where we were
+		return err
+	}
+	GS.Vendor = vendor
+	GS.Exit = exit
+	GS.ExitPath = append([]string{vendor}, path...)
+	GS.ExitIPs = serverIPs(vendor, exit, path)
+	GS.Chain, GS.Hops = chain, hops
+	GS.SetState(tribool.False)
+
+	success, err := GS.VPN.Restart()
+	if err != nil || !success {
+		// the hops of a chain which came up were torn down again and in
+		// make_before_break mode the old tunnel is still up.  Either way,
+		// remember the previous exit is where we are.
+		if len(hops) > 1 || (len(prevHops) < 2 && GS.VPN.SwitchMode() == vpn.SwitchMakeBeforeBreak) {
+			if rerr := GS.VPN.Rollback(saved); rerr != nil {
+				log.Printf("Unable to restore the config for %s: %s", prevExit, rerr.Error())
+			}
+			GS.Vendor, GS.Exit, GS.ExitPath, GS.ExitIPs = prevVendor, prevExit, prevPath, prevIPs
+			GS.Chain, GS.Hops = prevChain, prevHops
+			GS.SetState(tribool.Maybe)
+		}
+		if err == nil {
+			err = fmt.Errorf("VPN restart to %s failed", exit)
+		}
+		return err
+	}
+
+	GS.SwitchedAt = time.Now()
+	// only for display, so don't fail the switch over it
+	GS.StatusOutput = ""
+	if buf, err := GS.VPN.Status(); err != nil {
+		log.Printf("Error getting Status(): %s", err.Error())
+	} else {
+		GS.StatusOutput = buf.String()
+	}
+	log.Printf("VPN restart was successful\n")
+	GS.SetState(tribool.True)
+	if GS.Monitor != nil {
+		GS.Monitor.restoreFailOpen()
+	}
+	if GS.DNS != nil {
+		// before verifying so the leak check sees the new servers
+		GS.DNS.Apply(vendor, exit, path)
+	}
+	if Konf.Bool("verify.enabled") {
+		go verifyAfterSwitch()
+	}
+	if GS.PolicyRouting != nil {
+		// clients may have been using the old or new exit
+		go GS.PolicyRouting.Apply()
+	}
+	if GS.SplitTunnel != nil {
+		// errors are on the Split Tunnel tab, the switch itself worked
+		GS.SplitTunnel.ApplySwitch()
+	}
+	return nil
+}
+
+// for the status page
+func (gs GlobalState) ExitIPv4() []string {
+	v4, _ := vpn.SplitFamilies(gs.ExitIPs)
+	return v4
+}
+
+func (gs GlobalState) ExitIPv6() []string {
+	_, v6 := vpn.SplitFamilies(gs.ExitIPs)
+	return v6
+}
+
+/*
+ * Retry a single server with exponential backoff
+ */
+func trySwitchWithRetries(sp SwitchPolicy, vendor string, exit string, path []string) error {
+	return retrySwitch(sp, exit, func() error {
+		return trySwitch(vendor, exit, path)
+	})
+}
+
+func retrySwitch(sp SwitchPolicy, name string, try func() error) error {
+	var err error
+	backoff := sp.Backoff
+	for attempt := 1; attempt <= sp.Retries; attempt++ {
+		err = try()
+		if err == nil {
+			return nil
+		}
+		log.Printf("Attempt %d/%d to switch to %s failed: %s", attempt, sp.Retries, name, err.Error())
+		if attempt < sp.Retries {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return err
+}
+
+/*
+ * Switch to the given location (a leaf in the vendor ServerMap) using the
+ * SwitchPolicy.  If first is set, it is tried before any of the other
+ * servers in the location.  Returns the server we ended up on.
+ */
+func switchLocation(vendor string, location []string, first string) (string, error) {
+	switchMux.Lock()
+	defer switchMux.Unlock()
+
+	vc, err := getVendorConfig(vendor)
+	if err != nil {
+		return "", err
+	}
+	node, err := vc.Servers.getNode(location)
+	if err != nil {
+		return "", err
+	}
+
+	sp := getSwitchPolicy()
+	if len(first) > 0 {
+		if ss, bad := node.serverStatus(first); bad {
+			return "", fmt.Errorf("Refusing to switch to %s: %s", first, ss.String())
+		}
+	}
+	candidates := node.usableServers(node.locationServers())
+	if sp.Fallback == "random" {
+		rand.Shuffle(len(candidates), func(i, j int) {
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		})
+	}
+	if len(first) > 0 {
+		siblings := candidates
+		candidates = []string{first}
+		if sp.Fallback != "none" {
+			for _, c := range siblings {
+				if c != first {
+					candidates = append(candidates, c)
+				}
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("No usable servers in %s / %s", vendor, strings.Join(location, " / "))
+	}
+
+	failed := []string{}
+	for _, exit := range candidates {
+		path := append([]string{}, location...)
+		if p, ferr := FindServerMapEntry(node, exit); ferr == nil {
+			path = append(path, p...)
+		} else {
+			path = append(path, exit)
+		}
+		err = trySwitchWithRetries(sp, vendor, exit, path)
+		if err == nil {
+			if len(failed) > 0 {
+				log.Printf("Switched to %s after %s failed", exit, strings.Join(failed, ", "))
+			}
+			return exit, nil
+		}
+		failed = append(failed, exit)
+	}
+	return "", fmt.Errorf("Unable to switch to any server in %s / %s (tried %s): %s",
+		vendor, strings.Join(location, " / "), strings.Join(failed, ", "), err.Error())
+}
+
+/*
+ * Switch to the server at the exit ID path (or just the name of the
+ * server), falling back to its siblings
+ */
+func switchExit(vendor string, path []string) (string, error) {
+	vc, err := getVendorConfig(vendor)
+	if err != nil {
+		return "", err
+	}
+	path, err = findExit(&vc.Servers, path)
+	if err != nil {
+		return "", err
+	}
+	return switchLocation(vendor, vc.Servers.locationPath(path), path[len(path)-1])
+}
+
+func getVendorConfig(vendor string) (*VendorConfig, error) {
+	if GS.Vendors == nil {
+		return nil, fmt.Errorf("Vendors are still loading.  Please try again soon.")
+	}
+	vc, ok := GS.Vendors[vendor]
+	if !ok {
+		return nil, fmt.Errorf("Unknown vendor: %s", vendor)
+	}
+	return vc, nil
+}
+
+/*
+ * Returns the node at the given path
+ */
+func (sm *ServerMap) getNode(path []string) (*ServerMap, error) {
+	node := sm
+	for _, key := range path {
+		next, ok := node.getMap()[key]
+		if !ok {
+			return nil, fmt.Errorf("Invalid path: %s", strings.Join(path, " / "))
+		}
+		node = next
+	}
+	return node, nil
+}
+
+/*
+ * Returns the path of the location (city) that the server at path lives in.
+ * With resolve_servers, an IP may live under a FQDN so we need to look for
+ * the node which holds all the servers of the location.
+ */
+func (sm *ServerMap) locationPath(path []string) []string {
+	loc := path[:len(path)-1]
+	for i := len(loc); i > 0; i-- {
+		node, err := sm.getNode(loc[:i])
+		if err == nil && node.LinkKeys {
+			return loc[:i]
+		} else if err == nil && node.Server {
+			return loc[:i-1]
+		}
+	}
+	return loc
+}
+
+/*
+ * All the servers in a location: IPs & servers in the list in config
+ * order followed by the (sorted) FQDNs
+ */
+func (sm *ServerMap) locationServers() []string {
+	servers := append([]string{}, sm.getList()...)
+	keys := []string{}
+	for key := range sm.getMap() {
+		if sm.isServer(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return append(servers, keys...)
+}
+
+/*
+ * Returns the paths of all the locations at or below path
+ */
+func (sm *ServerMap) locations(path []string) [][]string {
+	node, err := sm.getNode(path)
+	if err != nil {
+		return [][]string{}
+	}
+	if node.LinkKeys || !node.hasMap() {
+		return [][]string{path}
+	}
+	locs := [][]string{}
+	if node.hasServers() {
+		// servers listed next to sub-levels
+		locs = append(locs, path)
+	}
+	keys := []string{}
+	for key := range node.getMap() {
+		if !node.isServer(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		locs = append(locs, sm.locations(append(append([]string{}, path...), key))...)
+	}
+	return locs
+}
+
+/*
+ * An ExitSpec names where to switch to in the config for the monitor,
+ * scheduler, etc.  Either a single server via `id` (the exit ID) or
+ * `exit`, or a `location` which is a list of levels or a "/" delimited
+ * string.  An `exit` is looked for in the `location` first.  With
+ * `auto: true` we switch to the best scoring exit in the location instead.
+ */
+type ExitSpec struct {
+	Vendor   string
+	Location []string
+	Exit     string
+	Auto     bool // auto-select the best exit in Location
+}
+
+func newExitSpec(k *koanf.Koanf) ExitSpec {
+	es := ExitSpec{
+		Vendor:   k.String("vendor"),
+		Location: k.Strings("location"),
+		Exit:     k.String("exit"),
+		Auto:     k.Bool("auto"),
+	}
+	if len(es.Location) == 0 && len(k.String("location")) > 0 {
+		es.Location = strings.Split(k.String("location"), "/")
+	}
+	if id := k.String("id"); len(id) > 0 {
+		vendor, path, err := parseExitID(id)
+		if err != nil || len(path) == 0 {
+			log.Printf("Warning: ignoring invalid exit id %s", id)
+		} else {
+			es.Vendor, es.Location, es.Exit = vendor, path[:len(path)-1], path[len(path)-1]
+		}
+	}
+	return es
+}
+
+/*
+ * The exit ID path of the Exit, which may just be the server name
+ */
+func (es ExitSpec) path() []string {
+	return append(append([]string{}, es.Location...), es.Exit)
+}
+
+func (es ExitSpec) String() string {
+	parts := append([]string{es.Vendor}, es.Location...)
+	if len(es.Exit) > 0 {
+		parts = append(parts, es.Exit)
+	} else if es.Auto {
+		parts = append(parts, "(auto)")
+	}
+	return strings.Join(parts, " / ")
+}
+
+/*
+ * Switch to the ExitSpec.  Returns the server we ended up on.
+ */
+func (es ExitSpec) switchTo() (string, error) {
+	if es.Auto {
+		result, err := autoSelect(es.Vendor, es.Location)
+		if err != nil {
+			return "", err
+		}
+		return result.Selected, nil
+	}
+	if len(es.Exit) > 0 {
+		return switchExit(es.Vendor, es.path())
+	}
+	return switchLocation(es.Vendor, es.Location, "")
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+/*
+ * A trial switch works like JunOS `commit confirmed`: unless someone
+ * confirms it before Deadline, we switch back to the previous exit.
+ */
+type TrialSwitch struct {
+	FromVendor   string
+	FromExit     string
+	FromExitPath []string
+	FromChain    string // revert to this multi-hop chain
+	Vendor       string
+	Exit         string
+	ExitPath     []string
+	Chain        string
+	Deadline     time.Time
+	timer        *time.Timer
+}
+
+// time left until we revert, for the status page
+func (ts *TrialSwitch) Remaining() string {
+	left := time.Until(ts.Deadline)
+	if left < 0 {
+		left = 0
+	}
+	return left.Round(time.Second).String()
+}
+
+/*
+ * Returns how long a trial should last if the request asked for one.
+ * `?trial=<seconds>` or `?trial=1` to use `trial.timeout_seconds`
+ */
+func trialTimeout(c echo.Context) (time.Duration, bool) {
+	trial := c.QueryParam("trial")
+	if len(trial) == 0 {
+		return 0, false
+	}
+	secs, err := strconv.Atoi(trial)
+	if err != nil || secs <= 1 {
+		secs = 300
+		if Konf.Int("trial.timeout_seconds") > 0 {
+			secs = Konf.Int("trial.timeout_seconds")
+		}
+	}
+	return time.Duration(secs) * time.Second, true
+}
+
+/*
+ * Runs doSwitch and, if it worked, schedules a revert to where we were
+ * unless confirmTrial() is called within timeout.
+ */
+func trialSwitch(timeout time.Duration, doSwitch func() (string, error)) (string, error) {
+	psMux.Lock()
+	pending := PS.Trial
+	psMux.Unlock()
+
+	ts := &TrialSwitch{
+		FromVendor:   GS.Vendor,
+		FromExit:     GS.Exit,
+		FromExitPath: GS.ExitPath,
+		FromChain:    GS.Chain,
+	}
+	if pending != nil {
+		// always revert to the last confirmed exit
+		pending.stop()
+		ts.FromVendor, ts.FromExit, ts.FromExitPath = pending.FromVendor, pending.FromExit, pending.FromExitPath
+		ts.FromChain = pending.FromChain
+	} else if GS.Exit == "Unselected" {
+		return "", fmt.Errorf("Trial switches need a current exit to revert to")
+	}
+
+	exit, err := doSwitch()
+	if err != nil {
+		if pending != nil {
+			pending.start()
+		}
+		return exit, err
+	}
+
+	ts.Vendor, ts.Exit, ts.ExitPath, ts.Chain = GS.Vendor, GS.Exit, GS.ExitPath, GS.Chain
+	ts.Deadline = time.Now().Add(timeout)
+	psMux.Lock()
+	PS.Trial = ts
+	psMux.Unlock()
+	saveState()
+	ts.start()
+	log.Printf("Trial switch to %s / %s, reverting to %s / %s at %s unless confirmed",
+		ts.Vendor, ts.Exit, ts.FromVendor, ts.FromExit, ts.Deadline.Format(time.RFC1123))
+	return exit, nil
+}
+
+func (ts *TrialSwitch) start() {
+	ts.timer = time.AfterFunc(time.Until(ts.Deadline), func() {
+		if err := revertTrial(ts); err != nil {
+			log.Printf("Unable to revert trial switch: %s", err.Error())
+		}
+	})
+}
+
+func (ts *TrialSwitch) stop() {
+	if ts.timer != nil {
+		ts.timer.Stop()
+	}
+}
+
+/*
+ * Forget about the pending trial (if any) because the switch was confirmed
+ * or someone made a regular switch
+ */
+func confirmTrial() bool {
+	return endTrial("confirmed")
+}
+
+/*
+ * The health monitor, scheduler & rotation moved us off the trial exit,
+ * so reverting later would undo their switch
+ */
+func dropTrial(by string) bool {
+	return endTrial("replaced by " + by)
+}
+
+func endTrial(why string) bool {
+	psMux.Lock()
+	ts := PS.Trial
+	PS.Trial = nil
+	psMux.Unlock()
+	if ts == nil {
+		return false
+	}
+	ts.stop()
+	saveState()
+	log.Printf("Trial switch to %s / %s %s", ts.Vendor, ts.Exit, why)
+	return true
+}
+
+func revertTrial(ts *TrialSwitch) error {
+	psMux.Lock()
+	if PS.Trial != ts {
+		// confirmed or replaced while we were waiting
+		psMux.Unlock()
+		return nil
+	}
+	PS.Trial = nil
+	psMux.Unlock()
+	ts.stop()
+	saveState()
+
+	log.Printf("Reverting trial switch from %s / %s to %s / %s", ts.Vendor, ts.Exit, ts.FromVendor, ts.FromExit)
+	if len(ts.FromChain) > 0 {
+		_, err := switchChain(ts.FromChain)
+		return err
+	}
+	path := []string{ts.FromExit}
+	if len(ts.FromExitPath) > 1 {
+		path = ts.FromExitPath[1:]
+	}
+	// exactly where we were, not one of its siblings
+	switchMux.Lock()
+	defer switchMux.Unlock()
+	return trySwitch(ts.FromVendor, ts.FromExit, path)
+}
+
+/*
+ * Called at startup to pick up a trial which was pending when we exited
+ */
+func resumeTrial() {
+	psMux.Lock()
+	ts := PS.Trial
+	psMux.Unlock()
+	if ts == nil {
+		return
+	}
+	GS.Vendor, GS.Exit, GS.ExitPath, GS.Chain = ts.Vendor, ts.Exit, ts.ExitPath, ts.Chain
+	// reverting needs the ServerMap
+	for GS.Vendors == nil {
+		time.Sleep(time.Second)
+	}
+	log.Printf("Resuming trial switch to %s / %s, reverting in %s", ts.Vendor, ts.Exit, ts.Remaining())
+	ts.start()
+}
+
+/*
+ * UI: POST /trial/confirm
+ */
+func TrialConfirm(c echo.Context) error {
+	if !confirmTrial() {
+		return c.Render(http.StatusOK, "error.html", "No trial switch is pending")
+	}
+	return c.Redirect(http.StatusSeeOther, "/#status")
+}
+
+/*
+ * UI: POST /trial/revert
+ */
+func TrialRevert(c echo.Context) error {
+	psMux.Lock()
+	ts := PS.Trial
+	psMux.Unlock()
+	if ts == nil {
+		return c.Render(http.StatusOK, "error.html", "No trial switch is pending")
+	}
+	if err := revertTrial(ts); err != nil {
+		return c.Render(http.StatusOK, "error.html", err.Error())
+	}
+	return c.Redirect(http.StatusSeeOther, "/#status")
+}
+
+/*
+ * AJAX: return the pending trial switch (if any)
+ */
+func trial(c echo.Context) error {
+	psMux.Lock()
+	ts := PS.Trial
+	psMux.Unlock()
+	if ts == nil {
+		return c.JSONPretty(http.StatusOK, map[string]interface{}{"Pending": false}, " ")
+	}
+	return c.JSONPretty(http.StatusOK, map[string]interface{}{
+		"Pending":   true,
+		"From":      strings.Join(ts.FromExitPath, " / "),
+		"To":        strings.Join(ts.ExitPath, " / "),
+		"Deadline":  ts.Deadline,
+		"Remaining": ts.Remaining(),
+	}, " ")
+}
+
+/*
+ * Switch as a trial if the request asked for one.  A regular switch
+ * replaces any pending trial.
+ */
+func requestSwitch(c echo.Context, doSwitch func() (string, error)) (string, error) {
+	if timeout, ok := trialTimeout(c); ok {
+		return trialSwitch(timeout, doSwitch)
+	}
+	exit, err := doSwitch()
+	if err == nil {
+		confirmTrial()
+	}
+	return exit, err
+}
+
+// for the status page
+func (gs GlobalState) PendingTrial() *TrialSwitch {
+	psMux.Lock()
+	defer psMux.Unlock()
+	return PS.Trial
+}
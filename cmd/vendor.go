@@ -1,18 +1,20 @@
 package main
 
 import (
-	"fmt"
 	"log"
 	"net"
-	"strings"
 	"time"
+
+	"github.com/synfinatic/vpnexiter/vpn"
 )
 
 type VendorConfig struct {
-	Name     string
-	Template string
-	Levels   []string
-	Servers  ServerMap
+	Name      string
+	Template  string
+	Levels    []string
+	Servers   ServerMap
+	Refreshed time.Time // when the servers were resolved
+	Stale     bool      `json:"-"` // from the catalog_file, not refreshed yet
 }
 
 /*
@@ -20,118 +22,129 @@ type VendorConfig struct {
  */
 func LoadVendors() map[string]*VendorConfig {
 	vcmap := map[string]*VendorConfig{}
-
 	for _, vendor := range Konf.Strings("vendors") {
-		log.Printf("Loading: %s", vendor)
-		begin := time.Now()
-		vcmap[vendor] = &VendorConfig{
-			Name:    vendor,
-			Levels:  []string{},
-			Servers: *newServerMap(nil, "", vendor, false),
-		}
-
-		if Konf.Exists(vendor + ".levels") {
-			vcmap[vendor].Levels = append(vcmap[vendor].Levels, Konf.Strings(vendor+".levels")...)
-		}
-
-		start := []string{vendor, "servers"}
-		search := strings.Join(start, ".")
-		resolve := Konf.Bool(vendor + ".resolve_servers")
-		if len(vcmap[vendor].Levels) == 0 {
-			vcmap[vendor].Servers.loadServers(search, "", resolve)
-		} else {
-			buildServerMap(&vcmap[vendor].Servers, start, vcmap[vendor].Levels, resolve)
-		}
-		t := time.Now()
-		log.Printf("Finished loading %s in %.2fsec", vendor, t.Sub(begin).Seconds())
+		vcmap[vendor] = LoadVendor(vendor)
 	}
 	return vcmap
 }
 
 /*
- * helper for buildServerMap().  Was intended to execute as a go-routine to
- * speed up DNS queries, but turns out that doesn't work on OSX because
- * net.LookupHost() is just a proxy for gethostbyname() which is not re-entrant.
- *
- * More info: https://golang.org/pkg/net/#hdr-Name_Resolution
+ * Loads a single vendor, tracking the progress in Loading
  */
-func (sm *ServerMap) loadServers(search string, key string, resolve bool) {
-	serverSearch := search
+func LoadVendor(vendor string) *VendorConfig {
+	log.Printf("Loading: %s", vendor)
+	begin := time.Now()
+	vc := &VendorConfig{
+		Name:    vendor,
+		Levels:  []string{},
+		Servers: *newServerMap(nil, "", vendor, false),
+	}
 
-	/*
-	 * if key is empty, then we don't want to add another level to sm, but rather
-	 * we want to add items directly to sm
-	 */
-	if len(key) > 0 {
-		serverSearch = fmt.Sprintf("%s.%s", search, key)
+	if Konf.Exists(vendor + ".levels") {
+		vc.Levels = append(vc.Levels, Konf.Strings(vendor+".levels")...)
+	}
+
+	level, err := configLevel(vendor, []string{})
+	if err != nil {
+		log.Printf("Unable to load %s: %s", vendor, err.Error())
+		level = newServerLevel()
+	}
+	resolve := Konf.Bool(vendor + ".resolve_servers")
+	hosts := []string{}
+	if resolve && HostResolver != nil {
+		hosts = uniqueHosts(level.allServers())
 	}
-	servers := Konf.Strings(serverSearch)
-	if resolve {
-		l := newServerMap(sm, key, sm.Vendor, true)
-		for _, fqdn := range servers {
-			svrs := []string{}
-			if net.ParseIP(fqdn) == nil {
-				// is a FQDN, so should be fqdn => [ip1, ip2]
-				addrs, err := net.LookupHost(fqdn)
-				if err != nil {
-					log.Printf("Error resolving %s: %s", fqdn, err.Error())
-					continue
-				} else {
-					svrs = append(svrs, addrs...)
-				}
-			} else {
-				// is an IP address so should be => [ip1, ip2]
-				ip := []string{fqdn}
-				l.appendList(ip)
-			}
-			// if we have one or more servers, add a level
-			if len(svrs) > 0 {
-				l.addList(fqdn, svrs)
-			}
+	Loading.start(vendor, len(hosts))
+	if len(hosts) > 0 {
+		// so loadServers() finds them all in the cache
+		HostResolver.ResolveAll(hosts, func(host string, err error) {
+			Loading.resolved(vendor, host, err)
+		})
+	}
+	buildServerMap(&vc.Servers, level, resolve)
+	vc.Refreshed = time.Now()
+	Loading.finish(vendor)
+	log.Printf("Finished loading %s in %.2fsec", vendor, vc.Refreshed.Sub(begin).Seconds())
+	return vc
+}
+
+/*
+ * helper for buildServerMap().  Lookups go via HostResolver, which
+ * LoadVendors() has already filled concurrently, so this is usually just
+ * reading the cache.
+ *
+ * if key is empty, then we don't want to add another level to sm, but rather
+ * we want to add items directly to sm
+ */
+func (sm *ServerMap) loadServers(key string, servers []string, info map[string]vpn.ServerInfo, resolve bool) {
+	l := newServerMap(sm, key, sm.Vendor, resolve)
+	family := vpn.AddressFamily(Konf, sm.Vendor)
+	for _, server := range servers {
+		if si, ok := info[server]; ok {
+			l.setInfo(server, si)
 		}
-		// if we have a key add a level to sm
-		if len(key) > 0 {
-			sm.addMap(key, l)
+		if disabledServer(sm.Vendor, server) {
+			l.markUnavailable(server, ServerStatus{Status: StatusDisabled, LastError: "listed in disabled_servers"})
+			continue
+		} else if !l.serverInfo(server).Enabled {
+			l.markUnavailable(server, ServerStatus{Status: StatusDisabled, LastError: "enabled: false"})
+			continue
+		}
+		if !resolve {
+			// DNS resolution is off
+			l.appendList([]string{server})
+			continue
+		}
+		// IPs are returned as-is if they are in the family
+		addrs, err := vpn.ResolveHost(server, family)
+		if err != nil {
+			log.Printf("Error resolving %s: %s", server, err.Error())
+			l.markUnavailable(server, ServerStatus{Status: StatusUnresolvable, LastError: err.Error()})
+		} else if net.ParseIP(server) == nil {
+			// is a FQDN, so should be fqdn => [ip1, ip2]
+			l.addList(server, addrs)
 		} else {
-			// no key?  move the elments of l into sm
-			sm.appendList(l.getList())
-			for k, v := range l.getMap() {
-				sm.addMap(k, v)
-			}
+			// is an IP address so should be => [ip1, ip2]
+			l.appendList(addrs)
 		}
+	}
+	// if we have a key add a level to sm
+	if len(key) > 0 {
+		sm.addMap(key, l)
 	} else {
-		// DNS resolution is off
-		if len(key) > 0 {
-			sm.addList(key, servers)
-		} else {
-			sm.appendList(servers)
+		// no key?  move the elments of l into sm
+		sm.appendList(l.getList())
+		for k, v := range l.getMap() {
+			sm.addMap(k, v)
+		}
+		for k, v := range l.Unavailable {
+			sm.markUnavailable(k, v)
+		}
+		for k, v := range l.Info {
+			sm.setInfo(k, v)
 		}
 	}
 }
 
 /*
- * Recursive function to populate the ServerMap with the config
- * data from Viper
+ * Recursive function to populate the ServerMap from the levels of
+ * the config.  Levels without sub-levels are locations.
  */
-func buildServerMap(sm *ServerMap, location []string, levels []string, resolve bool) {
-	levelCount := len(levels)
-	search := strings.Join(location, ".")
-
-	if levelCount == 1 {
-		for _, key := range Konf.MapKeys(search) {
-			sm.loadServers(search, key, resolve)
-		}
-	} else {
-		// pop off the next level
-		levels := levels[1:len(levels)]
-		// Iterate over our Config Viper map[string]inteface{}
-		for _, key := range Konf.MapKeys(search) {
-			loc := append(location, key)
-			new_map := newServerMap(sm, key, sm.Vendor, false)
-			// attach our new_map to ourself
-			sm.addMap(key, new_map)
-			// recurse
-			buildServerMap(new_map, loc, levels, resolve)
+func buildServerMap(sm *ServerMap, level *ServerLevel, resolve bool) {
+	// servers listed next to sub-levels go straight into sm
+	if len(level.Servers) > 0 {
+		sm.loadServers("", level.Servers, level.Info, resolve)
+	}
+	for _, key := range level.keys() {
+		child := level.Levels[key]
+		if len(child.Levels) == 0 {
+			sm.loadServers(key, child.Servers, child.Info, resolve)
+			continue
 		}
+		new_map := newServerMap(sm, key, sm.Vendor, false)
+		// attach our new_map to ourself
+		sm.addMap(key, new_map)
+		// recurse
+		buildServerMap(new_map, child, resolve)
 	}
 }
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+/*
+ * A tunnel which is up can still leak or exit somewhere unexpected, so
+ * after each switch (and on demand) we check:
+ *
+ *  - the egress IP from `verify.ip_url` is near the server or in the
+ *    vendor's `egress_ranges`
+ *  - if we have IPv6 connectivity, the egress IP from `verify.ipv6_url`
+ *    passes the same check, otherwise IPv6 is leaking around the tunnel
+ *  - the resolvers seen by `verify.dns_leak.hostname` are in the tunnel
+ *  - the GeoIP country of the egress IP matches the ExitPath
+ *
+ * Any Problems mark the tunnel Degraded.
+ */
+type Verification struct {
+	Time        time.Time
+	ExitPath    []string
+	EgressIP    string
+	EgressIPv6  string
+	Country     string // ISO code
+	CountryName string
+	ASN         uint64
+	ASOrg       string
+	Resolvers   []string
+	Problems    []string
+	// no ranges or ASNs to check EgressIPv6 against
+	IPv6Unverified bool `json:",omitempty"`
+}
+
+func (v *Verification) Degraded() bool {
+	return len(v.Problems) > 0
+}
+
+func (v *Verification) problem(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Printf("Verification: %s", msg)
+	v.Problems = append(v.Problems, msg)
+}
+
+var verifyMux sync.Mutex
+var mmdbCache = map[string]*MMDB{}
+
+/*
+ * Opens the mmdb file named by the config key and caches it.  Failures
+ * aren't cached, so a missing or partly downloaded database is retried
+ * on the next verification.  Returns nil, nil if the key isn't set.
+ */
+func getMMDB(key string) (*MMDB, error) {
+	fname := Konf.String(key)
+	if len(fname) == 0 {
+		return nil, nil
+	}
+	if db, ok := mmdbCache[fname]; ok {
+		return db, nil
+	}
+	db, err := OpenMMDB(fname)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open %s %s: %s", key, fname, err.Error())
+	}
+	mmdbCache[fname] = db
+	return db, nil
+}
+
+func verifyTimeout() time.Duration {
+	if Konf.Int("verify.timeout_seconds") > 0 {
+		return time.Duration(Konf.Int("verify.timeout_seconds")) * time.Second
+	}
+	return 10 * time.Second
+}
+
+/*
+ * Fetches our public IP over network (tcp, tcp4 or tcp6) from the URL in
+ * key.  The endpoint can return the IP as plain text or JSON with an `ip`
+ * field
+ */
+func fetchEgressIP(key string, url string, network string) (string, error) {
+	if len(Konf.String(key)) > 0 {
+		url = Konf.String(key)
+	}
+	dialer := &net.Dialer{}
+	client := &http.Client{
+		Timeout: verifyTimeout(),
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", err
+	}
+	text := strings.TrimSpace(string(body))
+	if net.ParseIP(text) != nil {
+		return text, nil
+	}
+	var js struct {
+		IP string `json:"ip"`
+	}
+	if json.Unmarshal(body, &js) == nil && net.ParseIP(js.IP) != nil {
+		return js.IP, nil
+	}
+	return "", fmt.Errorf("No IP address in the response from %s", url)
+}
+
+/*
+ * The networks our egress IP is allowed to be in: the subnet of each of
+ * the server's IPs plus the vendor's `egress_ranges`
+ */
+func egressNets(vendor string, path []string) []*net.IPNet {
+	bits4, bits6 := 24, 64
+	if Konf.Int("verify.subnet_bits") > 0 {
+		bits4 = Konf.Int("verify.subnet_bits")
+	}
+	if Konf.Int("verify.subnet_bits_v6") > 0 {
+		bits6 = Konf.Int("verify.subnet_bits_v6")
+	}
+	nets := []*net.IPNet{}
+	if len(path) > 0 {
+		for _, s := range serverIPs(vendor, path[len(path)-1], path) {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				continue
+			}
+			if ip.To4() != nil {
+				nets = append(nets, &net.IPNet{IP: ip.Mask(net.CIDRMask(bits4, 32)), Mask: net.CIDRMask(bits4, 32)})
+			} else {
+				nets = append(nets, &net.IPNet{IP: ip.Mask(net.CIDRMask(bits6, 128)), Mask: net.CIDRMask(bits6, 128)})
+			}
+		}
+	}
+	return append(nets, parseCIDRs(fmt.Sprintf("%s.egress_ranges", vendor))...)
+}
+
+func parseCIDRs(key string) []*net.IPNet {
+	nets := []*net.IPNet{}
+	for _, cidr := range Konf.Strings(key) {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Printf("Warning: invalid CIDR %s in `%s`", cidr, key)
+			continue
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// a /32 or /128 for the IP
+func hostNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+func inNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Traffic which can reach the internet over IPv6 must exit via the
+ * tunnel too.  No IPv6 connectivity at all is fine.
+ */
+func (v *Verification) checkIPv6(nets []*net.IPNet) {
+	egress, err := fetchEgressIP("verify.ipv6_url", "https://api6.ipify.org", "tcp6")
+	if err != nil {
+		log.Printf("Verification: no IPv6 connectivity: %s", err.Error())
+		return
+	}
+	v.EgressIPv6 = egress
+	ip := net.ParseIP(egress)
+	if ip.To4() != nil {
+		v.problem("verify.ipv6_url returned the IPv4 address %s", egress)
+		return
+	}
+	if inNets(ip, nets) {
+		return
+	}
+	asn, _ := asnOf(ip)
+	if asn != 0 && asn == v.ASN {
+		return
+	}
+	if !hasIPv6(nets) && (asn == 0 || v.ASN == 0) {
+		// like IPv4: without ranges or ASNs to compare, no verdict
+		log.Printf("Verification: no IPv6 ranges or ASN data to check the IPv6 egress %s against", egress)
+		v.IPv6Unverified = true
+		return
+	}
+	v.problem("IPv6 egress %s is outside the tunnel, possible IPv6 leak", egress)
+}
+
+func hasIPv6(nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.IP.To4() == nil {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Asks the resolver-echo service which resolvers our queries come from
+ */
+func dnsResolvers() ([]string, error) {
+	hostname := Konf.String("verify.dns_leak.hostname")
+	if Konf.String("verify.dns_leak.type") == "TXT" {
+		txts, err := net.LookupTXT(hostname)
+		if err != nil {
+			return nil, err
+		}
+		ips := []string{}
+		for _, txt := range txts {
+			if net.ParseIP(txt) != nil {
+				ips = append(ips, txt)
+			}
+		}
+		return ips, nil
+	}
+	return net.LookupHost(hostname)
+}
+
+func asnOf(ip net.IP) (uint64, string) {
+	// verifyTunnel() reports if we can't open it
+	db, _ := getMMDB("verify.asn_db")
+	if db == nil {
+		return 0, ""
+	}
+	record, err := db.Lookup(ip)
+	if err != nil || record == nil {
+		return 0, ""
+	}
+	asn, _ := mmdbGet(record, "autonomous_system_number").(uint64)
+	org, _ := mmdbGet(record, "autonomous_system_organization").(string)
+	return asn, org
+}
+
+/*
+ * true if one of the levels in the path is the country.  Levels which
+ * don't use the country name (ie: `USA`) can be mapped to the ISO code
+ * via `verify.country_aliases`
+ */
+func pathHasCountry(path []string, iso string, name string) bool {
+	for _, level := range path {
+		// level names can have dots, so no Konf.String()
+		value, _ := configValue("verify", "country_aliases", level)
+		alias, _ := value.(string)
+		if strings.EqualFold(level, iso) || strings.EqualFold(level, name) || strings.EqualFold(alias, iso) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Runs all the configured checks against the current exit and saves the
+ * result in GS.Verification
+ */
+func verifyTunnel() *Verification {
+	verifyMux.Lock()
+	defer verifyMux.Unlock()
+
+	v := &Verification{
+		Time:      time.Now(),
+		ExitPath:  GS.ExitPath,
+		Resolvers: []string{},
+		Problems:  []string{},
+	}
+	vendor, path := GS.Vendor, []string{}
+	if len(GS.ExitPath) > 0 {
+		path = GS.ExitPath[1:]
+	}
+
+	egress, err := fetchEgressIP("verify.ip_url", "https://api.ipify.org", "tcp")
+	if err != nil {
+		v.problem("Unable to fetch egress IP: %s", err.Error())
+		GS.Verification = v
+		return v
+	}
+	v.EgressIP = egress
+	ip := net.ParseIP(egress)
+	nets := egressNets(vendor, path)
+	if len(nets) > 0 && !inNets(ip, nets) {
+		v.problem("Egress IP %s is not in the subnet of %s or the %s egress_ranges", egress, strings.Join(path, " / "), vendor)
+	}
+	if _, err := getMMDB("verify.asn_db"); err != nil {
+		v.problem("%s", err.Error())
+	}
+	v.ASN, v.ASOrg = asnOf(ip)
+	if !Konf.Bool("verify.skip_ipv6") {
+		v.checkIPv6(nets)
+	}
+
+	if db, err := getMMDB("verify.geoip_db"); err != nil {
+		v.problem("%s", err.Error())
+	} else if db != nil {
+		record, err := db.Lookup(ip)
+		if err != nil {
+			v.problem("GeoIP lookup of %s failed: %s", egress, err.Error())
+		} else if record != nil {
+			v.Country, _ = mmdbGet(record, "country", "iso_code").(string)
+			v.CountryName, _ = mmdbGet(record, "country", "names", "en").(string)
+			if len(v.Country) > 0 && !pathHasCountry(path, v.Country, v.CountryName) {
+				v.problem("GeoIP places %s in %s (%s), expected %s", egress, v.CountryName, v.Country, strings.Join(path, " / "))
+			}
+		}
+	}
+
+	if len(Konf.String("verify.dns_leak.hostname")) > 0 {
+		resolvers, err := dnsResolvers()
+		if err != nil {
+			v.problem("DNS leak check failed: %s", err.Error())
+		}
+		allowed := append(parseCIDRs("verify.dns_leak.allowed"), nets...)
+		if GS.DNS != nil {
+			// the exit's own resolvers
+			for _, s := range GS.DNS.Servers {
+				allowed = append(allowed, hostNet(net.ParseIP(s)))
+			}
+		}
+		for _, r := range resolvers {
+			v.Resolvers = append(v.Resolvers, r)
+			rip := net.ParseIP(r)
+			if inNets(rip, allowed) || rip.Equal(ip) {
+				continue
+			}
+			if asn, _ := asnOf(rip); asn != 0 && asn == v.ASN {
+				continue
+			}
+			v.problem("DNS resolver %s is outside the tunnel, possible DNS leak", r)
+		}
+	}
+
+	if GS.DNS != nil {
+		for _, p := range GS.DNS.check() {
+			v.problem("%s", p)
+		}
+	}
+
+	if !v.Degraded() {
+		log.Printf("Verification of %s passed: egress %s", strings.Join(v.ExitPath, " / "), egress)
+	}
+	GS.Verification = v
+	return v
+}
+
+/*
+ * Called after every successful switch.  Gives the tunnel a few seconds
+ * to settle before we check it.
+ */
+func verifyAfterSwitch() {
+	delay := 5 * time.Second
+	if Konf.Exists("verify.delay_seconds") {
+		delay = time.Duration(Konf.Int("verify.delay_seconds")) * time.Second
+	}
+	time.Sleep(delay)
+	verifyTunnel()
+}
+
+// for the status page: only true if the verification is of the current exit
+func (gs GlobalState) Degraded() bool {
+	v := gs.Verification
+	return v != nil && v.Degraded() && strings.Join(v.ExitPath, "/") == strings.Join(gs.ExitPath, "/")
+}
+
+/*
+ * UI: verify the tunnel now
+ */
+func Verify(c echo.Context) error {
+	if GS.Exit == "Unselected" {
+		return c.Render(http.StatusOK, "error.html", "No exit selected")
+	}
+	verifyTunnel()
+	return c.Redirect(http.StatusTemporaryRedirect, "/#status")
+}
+
+/*
+ * AJAX: return the last verification.  Use `?run=1` to verify now.
+ */
+func verification(c echo.Context) error {
+	if len(c.QueryParam("run")) > 0 {
+		verifyTunnel()
+	}
+	if GS.Verification == nil {
+		return c.String(http.StatusNotFound, "No verification has been run")
+	}
+	return c.JSONPretty(http.StatusOK, GS.Verification, " ")
+}
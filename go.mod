@@ -8,5 +8,6 @@ require (
 	github.com/knadh/koanf v0.12.0
 	github.com/labstack/echo/v4 v4.9.0
 	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5
+	golang.org/x/net v0.0.0-20211015210444-4f30a5c0130f
 	gopkg.in/grignaak/tribool.v1 v1.0.0-20150312065122-d6bb19d816df
 )
@@ -0,0 +1,142 @@
+package vpn
+
+import (
+	"fmt"
+	"log"
+)
+
+/*
+ * A multi-hop exit is a chain of tunnels where each hop runs inside the
+ * previous one: Hops[0] is the outer tunnel we connect to first and the
+ * last hop is where our traffic exits.
+ *
+ * Each hop gets its own connection from `router.chain.connections` and
+ * its own config file (so `router.config_file` should use
+ * `{{.Connection}}`).  Hops are brought up outer first with
+ * `router.chain.up_command` and torn down in reverse with
+ * `router.chain.down_command`.  Both commands and `router.check.command`
+ * are rendered for each hop, so they can use `{{.Connection}}`,
+ * `{{.Vendor}}` and `{{.Exit}}`.
+ */
+type Hop struct {
+	Vendor string
+	Exit   string
+	Info   ServerInfo
+}
+
+// A hop as seen by the config template
+type HopTemplate struct {
+	VpnServer  string
+	Vendor     string
+	Server     ServerInfo
+	Connection string
+	IPv4       []string
+	IPv6       []string
+}
+
+func (vs *VpnServer) chainConnections() []string {
+	return vs.Konf.Strings("router.chain.connections")
+}
+
+func (vs *VpnServer) hopTemplates() []HopTemplate {
+	if len(vs.Hops) == 0 {
+		ht := HopTemplate{VpnServer: vs.Exit, Vendor: vs.Vendor, Server: vs.Info, Connection: vs.Connection}
+		ht.IPv4, ht.IPv6 = vs.exitAddrs(vs.Vendor, vs.Exit)
+		return []HopTemplate{ht}
+	}
+	conns := vs.chainConnections()
+	hops := []HopTemplate{}
+	for i, hop := range vs.Hops {
+		ht := HopTemplate{VpnServer: hop.Exit, Vendor: hop.Vendor, Server: hop.Info, Connection: conns[i]}
+		ht.IPv4, ht.IPv6 = vs.exitAddrs(hop.Vendor, hop.Exit)
+		hops = append(hops, ht)
+	}
+	return hops
+}
+
+/*
+ * Points vs at the given hop of the chain so the config & command
+ * templates render for it
+ */
+func (vs *VpnServer) selectHop(hops []Hop, i int) {
+	vs.hop = i
+	vs.Vendor = hops[i].Vendor
+	vs.Exit = hops[i].Exit
+	vs.Info = hops[i].Info
+	vs.Connection = vs.chainConnections()[i]
+}
+
+/*
+ * Writes the config for each hop of the chain.  Call Restart() to
+ * bring it up.
+ */
+func (vs *VpnServer) UpdateChain(hops []Hop) error {
+	if len(hops) < 2 {
+		return fmt.Errorf("A chain needs at least two hops")
+	}
+	if len(vs.chainConnections()) < len(hops) {
+		return fmt.Errorf("`router.chain.connections` needs a connection name for each of the %d hops", len(hops))
+	}
+	saved := vs.Snapshot()
+	vs.PrevHops = vs.Hops
+	vs.Hops = hops
+	for i := range hops {
+		vs.selectHop(hops, i)
+		if err := vs.writeConfig(); err != nil {
+			// nothing was restarted, but the configs of the hops written
+			// so far may belong to what is running
+			if rerr := vs.Rollback(saved); rerr != nil {
+				log.Printf("Unable to restore the previous config: %s", rerr.Error())
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * Tears down the hops in reverse order.  Errors are logged, since the
+ * tunnel may already be down.
+ */
+func (vs *VpnServer) stopChain(r Runner, hops []Hop) {
+	vendor, exit, info, conn, hop := vs.Vendor, vs.Exit, vs.Info, vs.Connection, vs.hop
+	defer func() {
+		vs.Vendor, vs.Exit, vs.Info, vs.Connection, vs.hop = vendor, exit, info, conn, hop
+	}()
+	for i := len(hops) - 1; i >= 0; i-- {
+		vs.selectHop(hops, i)
+		if _, err := vs.runCommands(r, "router.chain.down_command"); err != nil {
+			log.Printf("Unable to tear down hop %d %s: %s", i+1, vs.Exit, err.Error())
+		}
+	}
+}
+
+/*
+ * Stops whatever was running before and brings up the chain outer hop
+ * first, waiting for each hop before starting the next one.  If a hop
+ * fails, the hops which came up are torn down again.
+ */
+func (vs *VpnServer) restartChain(r Runner) (bool, error) {
+	hops := vs.Hops
+	if len(vs.PrevHops) > 0 {
+		vs.stopChain(r, vs.PrevHops)
+		vs.PrevHops = nil
+	} else if _, err := vs.runCommands(r, "router.stop_command"); err != nil {
+		return false, err
+	}
+
+	for i := range hops {
+		vs.selectHop(hops, i)
+		_, err := vs.runCommands(r, "router.chain.up_command")
+		if err == nil && !vs.waitUp(r) {
+			err = vs.notUpError()
+		}
+		if err != nil {
+			log.Printf("Hop %d of the chain failed, tearing down", i+1)
+			vs.stopChain(r, hops[:i+1])
+			return false, err
+		}
+		log.Printf("Hop %d of %d is up: %s / %s", i+1, len(hops), vs.Vendor, vs.Exit)
+	}
+	return true, nil
+}
@@ -0,0 +1,106 @@
+package vpn
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/knadh/koanf"
+)
+
+/*
+ * Which address families of a vendor's servers we use, from
+ * `<vendor>.address_family`:
+ *
+ * any:         both, in the order the resolver returns them (default)
+ * ipv4:        IPv4 only
+ * ipv6:        IPv6 only
+ * prefer_ipv4: both, IPv4 first
+ * prefer_ipv6: both, IPv6 first
+ */
+const (
+	FamilyAny        = "any"
+	FamilyIPv4       = "ipv4"
+	FamilyIPv6       = "ipv6"
+	FamilyPreferIPv4 = "prefer_ipv4"
+	FamilyPreferIPv6 = "prefer_ipv6"
+)
+
+// Replaceable so the caller can use a caching resolver
+var LookupHost = net.LookupHost
+
+func AddressFamily(konf *koanf.Koanf, vendor string) string {
+	family := konf.String(fmt.Sprintf("%s.address_family", vendor))
+	switch family {
+	case FamilyIPv4, FamilyIPv6, FamilyPreferIPv4, FamilyPreferIPv6:
+		return family
+	case "", FamilyAny:
+		return FamilyAny
+	default:
+		log.Printf("Warning: unknown `%s.address_family` %s, using %s", vendor, family, FamilyAny)
+		return FamilyAny
+	}
+}
+
+/*
+ * Splits the addresses into IPv4 & IPv6.  Anything which isn't an IP is
+ * dropped.
+ */
+func SplitFamilies(addrs []string) ([]string, []string) {
+	v4, v6 := []string{}, []string{}
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		if ip.To4() != nil {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+	return v4, v6
+}
+
+/*
+ * Filters & orders the addresses for the family
+ */
+func FilterFamily(family string, addrs []string) []string {
+	v4, v6 := SplitFamilies(addrs)
+	switch family {
+	case FamilyIPv4:
+		return v4
+	case FamilyIPv6:
+		return v6
+	case FamilyPreferIPv4:
+		return append(v4, v6...)
+	case FamilyPreferIPv6:
+		return append(v6, v4...)
+	}
+	ret := []string{}
+	for _, addr := range addrs {
+		if net.ParseIP(addr) != nil {
+			ret = append(ret, addr)
+		}
+	}
+	return ret
+}
+
+/*
+ * Resolves the host (or returns the IP as-is) and returns the addresses
+ * the family allows
+ */
+func ResolveHost(host string, family string) ([]string, error) {
+	addrs := []string{host}
+	if net.ParseIP(host) == nil {
+		var err error
+		if addrs, err = LookupHost(host); err != nil {
+			return []string{}, err
+		}
+	}
+	addrs = FilterFamily(family, addrs)
+	if len(addrs) == 0 {
+		return addrs, fmt.Errorf("%s has no %s addresses", host, family)
+	}
+	return addrs, nil
+}
@@ -0,0 +1,167 @@
+package vpn
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+)
+
+/*
+ * The kill switch blocks the `kill_switch.subnets` from reaching the
+ * internet via `kill_switch.wan_interface` unless the traffic is in the
+ * tunnel.
+ *
+ * The rules are rendered from a per-backend template (or your own
+ * `kill_switch.rules_template`) into `kill_switch.rules_file` on the
+ * router and loaded/removed by the `enable_command` and `disable_command`
+ * using the same Runner as the start/stop commands.  Errors from the
+ * `setup_command` are ignored, so it can remove things which may not
+ * exist yet.
+ */
+type KillSwitchTemplate struct {
+	Subnets      []KillSwitchSubnet
+	WanInterface string
+	RulesFile    string
+	Vendor       string
+	Exit         string
+}
+
+type KillSwitchSubnet struct {
+	CIDR string
+	IPv6 bool
+}
+
+type killSwitchBackend struct {
+	Rules   string
+	Setup   []string
+	Enable  []string
+	Disable []string
+}
+
+var killSwitchBackends = map[string]killSwitchBackend{
+	"nftables": {
+		Rules: `table inet vpnexiter {}
+delete table inet vpnexiter
+table inet vpnexiter {
+	chain killswitch {
+		type filter hook forward priority 0; policy accept;
+{{- range .Subnets }}
+		{{ if .IPv6 }}ip6{{ else }}ip{{ end }} saddr {{ .CIDR }} oifname "{{ $.WanInterface }}" rt ipsec missing drop
+{{- end }}
+	}
+}
+`,
+		Setup:   []string{},
+		Enable:  []string{"nft -f {{.RulesFile}}"},
+		Disable: []string{"nft delete table inet vpnexiter"},
+	},
+	// IPv4 only, use nftables or your own rules_template for IPv6
+	"iptables": {
+		Rules: `*filter
+:VPNEXITER - [0:0]
+-I FORWARD -j VPNEXITER
+{{- range .Subnets }}{{ if not .IPv6 }}
+-A VPNEXITER -s {{ .CIDR }} -o {{ $.WanInterface }} -m policy --dir out --pol none -j DROP
+{{- end }}{{ end }}
+COMMIT
+`,
+		Setup:   []string{"iptables -D FORWARD -j VPNEXITER"},
+		Enable:  []string{"iptables-restore -n {{.RulesFile}}"},
+		Disable: []string{"iptables -F VPNEXITER"},
+	},
+}
+
+func (vs *VpnServer) killSwitchBackend() (killSwitchBackend, error) {
+	name := vs.Konf.String("kill_switch.backend")
+	if len(name) == 0 {
+		name = "nftables"
+	}
+	backend, ok := killSwitchBackends[name]
+	if !ok && len(vs.Konf.String("kill_switch.rules_template")) == 0 {
+		return backend, fmt.Errorf("Unknown kill_switch.backend %s and no kill_switch.rules_template", name)
+	}
+	for key, cmds := range map[string]*[]string{
+		"kill_switch.setup_command":   &backend.Setup,
+		"kill_switch.enable_command":  &backend.Enable,
+		"kill_switch.disable_command": &backend.Disable,
+	} {
+		if c := vs.commands(key); len(c) > 0 {
+			*cmds = c
+		}
+	}
+	return backend, nil
+}
+
+func (vs *VpnServer) killSwitchTemplate() KillSwitchTemplate {
+	kst := KillSwitchTemplate{
+		Subnets:      []KillSwitchSubnet{},
+		WanInterface: vs.Konf.String("kill_switch.wan_interface"),
+		RulesFile:    vs.Konf.String("kill_switch.rules_file"),
+		Vendor:       vs.Vendor,
+		Exit:         vs.Exit,
+	}
+	if len(kst.WanInterface) == 0 {
+		kst.WanInterface = "eth0"
+	}
+	if len(kst.RulesFile) == 0 {
+		kst.RulesFile = "/tmp/vpnexiter-killswitch.rules"
+	}
+	for _, cidr := range vs.Konf.Strings("kill_switch.subnets") {
+		ip, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Printf("Warning: invalid kill_switch.subnets entry %s", cidr)
+			continue
+		}
+		kst.Subnets = append(kst.Subnets, KillSwitchSubnet{CIDR: cidr, IPv6: ip.To4() == nil})
+	}
+	return kst
+}
+
+/*
+ * The rules template: our backend's or the file in `kill_switch.rules_template`
+ */
+func (vs *VpnServer) killSwitchRules(backend killSwitchBackend) (string, error) {
+	fname := vs.Konf.String("kill_switch.rules_template")
+	if len(fname) == 0 {
+		return backend.Rules, nil
+	}
+	data, err := ioutil.ReadFile(fname)
+	return string(data), err
+}
+
+/*
+ * Installs (enable == true) or removes the kill switch rules
+ */
+func (vs *VpnServer) SetKillSwitch(enable bool) error {
+	backend, err := vs.killSwitchBackend()
+	if err != nil {
+		return err
+	}
+	kst := vs.killSwitchTemplate()
+	r, err := vs.NewRunner()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if !enable {
+		_, err = runTemplates(r, "kill_switch.disable_command", backend.Disable, kst)
+		return err
+	}
+
+	rules, err := vs.killSwitchRules(backend)
+	if err != nil {
+		return err
+	}
+	if err = vs.DeployTemplate("kill_switch.rules", rules, kst, kst.RulesFile); err != nil {
+		return err
+	}
+	for _, tmpl := range backend.Setup {
+		if _, err = runTemplates(r, "kill_switch.setup_command", []string{tmpl}, kst); err != nil {
+			log.Printf("Ignoring kill switch setup error: %s", err.Error())
+		}
+	}
+	_, err = runTemplates(r, "kill_switch.enable_command", backend.Enable, kst)
+	return err
+}
@@ -2,14 +2,10 @@ package vpn
 
 import (
 	"bytes"
-	"fmt"
 	"log"
 	"os"
 	"os/exec"
 	"strings"
-	"time"
-
-	"gopkg.in/grignaak/tribool.v1"
 )
 
 /*
@@ -21,7 +17,10 @@ func (vs *VpnServer) updateConfigLocal() error {
 		return err
 	}
 
-	config_file := vs.Konf.String("router.config_file")
+	config_file, err := vs.configFile()
+	if err != nil {
+		return err
+	}
 	err = os.Rename(cfile, config_file)
 	if err != nil {
 		return err
@@ -30,28 +29,6 @@ func (vs *VpnServer) updateConfigLocal() error {
 	return nil
 }
 
-func (vs *VpnServer) getUpLocal() tribool.Tribool {
-
-	tmpl := vs.Konf.String("router.check.command")
-	cmd, err := vs.renderGsTemplate("local.check.command", tmpl)
-	if err != nil {
-		log.Printf("Unable to render template: %s", tmpl)
-		return tribool.Maybe
-	}
-	log.Printf("running %s\n", cmd)
-	out, err := execLocalCommand(cmd)
-	if err != nil {
-		log.Printf("error running: %s\n", cmd)
-		return tribool.False
-	}
-	if strings.Contains(out.String(), vs.Konf.String("router.check.match")) {
-		log.Printf("Matched!\n")
-		return tribool.True
-	}
-	log.Printf("No match :(\n")
-	return tribool.False
-}
-
 /*
  * Exec a command locally
  * Returns stdout on success or stderr on error
@@ -94,37 +71,3 @@ func (vs *VpnServer) statusLocal() (bytes.Buffer, error) {
 	return out, nil
 
 }
-
-/*
- * Restart IPSec on the local host
- */
-func (vs *VpnServer) restartVpnLocal() (bool, error) {
-	var vpnUp bool = false
-
-	_, err := execLocalCommand(vs.Konf.String("router.stop_command"))
-	if err != nil {
-		return vpnUp, err
-	}
-	_, err = execLocalCommand(vs.Konf.String("router.start_command"))
-	if err != nil {
-		return vpnUp, err
-	}
-	// wait for VPN to come up
-	for i := 0; i < vs.WaitSeconds; i++ {
-		_, err = execLocalCommand(vs.Konf.String("router.check_command"))
-		if err != nil {
-			duration, _ := time.ParseDuration("1s")
-			time.Sleep(duration)
-			continue
-		} else {
-			vpnUp = true
-			break
-		}
-	}
-	if !vpnUp {
-		return vpnUp, fmt.Errorf(
-			"%s VPN to %s did not come up after %d seconds",
-			vs.Exit, vs.Vendor, vs.WaitSeconds)
-	}
-	return vpnUp, nil
-}
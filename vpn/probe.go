@@ -0,0 +1,301 @@
+package vpn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+/*
+ * A Probe checks if a VPN server is answering before we tear down our
+ * current tunnel.  Supported protocols:
+ *
+ * ike:       IKEv2 IKE_SA_INIT to UDP/500, then UDP/4500 (IPSec)
+ * openvpn:   P_CONTROL_HARD_RESET_CLIENT_V2 to UDP (OpenVPN w/o tls-auth)
+ * wireguard: router_command only
+ * tcp:       TCP connect (OpenVPN over TCP, or anything else)
+ *
+ * From is `local` to probe from this host or `router` to probe via ssh
+ * using `router_command`.
+ *
+ * WireGuard servers silently drop anything but a valid handshake from a
+ * known peer, which needs the router's private key.  That key never leaves
+ * the router, so WireGuard can only be probed by a `router_command`.
+ */
+type Probe struct {
+	Protocol      string
+	Ports         []int
+	Timeout       time.Duration
+	From          string
+	RouterCommand string
+}
+
+// Values available to `router_command`
+type ProbeTemplate struct {
+	IP       string
+	Port     int
+	Protocol string
+	Timeout  int
+	Payload  string // printf(1) escaped request packet for IKE & OpenVPN
+}
+
+var defaultProbePorts = map[string][]int{
+	"ike":       {500, 4500},
+	"openvpn":   {1194},
+	"wireguard": {51820},
+	"tcp":       {443},
+}
+
+var defaultRouterProbeCommands = map[string]string{
+	"tcp": "nc -z -w {{.Timeout}} {{.IP}} {{.Port}}",
+	"udp": "printf '{{.Payload}}' | nc -u -w {{.Timeout}} {{.IP}} {{.Port}} | head -c 1 | grep -q ''",
+}
+
+/*
+ * Per-vendor settings in `<vendor>.preflight` override `preflight`
+ */
+func (vs *VpnServer) probeKey(vendor string, key string) string {
+	vkey := fmt.Sprintf("%s.preflight.%s", vendor, key)
+	if vs.Konf.Exists(vkey) {
+		return vkey
+	}
+	return "preflight." + key
+}
+
+/*
+ * Returns the Probe for a vendor or nil if pre-flight checks are disabled
+ */
+func (vs *VpnServer) GetProbe(vendor string) *Probe {
+	protocol := vs.Konf.String(vs.probeKey(vendor, "protocol"))
+	if len(protocol) == 0 || protocol == "none" {
+		return nil
+	}
+	if _, ok := defaultProbePorts[protocol]; !ok {
+		log.Printf("Warning: unknown preflight protocol %s for %s, skipping", protocol, vendor)
+		return nil
+	}
+	p := &Probe{
+		Protocol:      protocol,
+		Ports:         defaultProbePorts[protocol],
+		Timeout:       3 * time.Second,
+		From:          vs.Konf.String(vs.probeKey(vendor, "from")),
+		RouterCommand: vs.Konf.String(vs.probeKey(vendor, "router_command")),
+	}
+	if protocol == "wireguard" && (p.From != "router" || vs.Type != "ssh" || len(p.RouterCommand) == 0) {
+		log.Printf("Warning: wireguard preflight for %s needs `from: router` and a router_command, skipping", vendor)
+		return nil
+	}
+	if port := vs.Konf.Int(vs.probeKey(vendor, "port")); port > 0 {
+		p.Ports = []int{port}
+	}
+	if t := vs.Konf.Int(vs.probeKey(vendor, "timeout_seconds")); t > 0 {
+		p.Timeout = time.Duration(t) * time.Second
+	}
+	return p
+}
+
+/*
+ * Returns nil if any of the IPs answer our probe
+ */
+func (vs *VpnServer) ProbeIPs(p *Probe, ips []string) error {
+	var r Runner
+	if p.From == "router" && vs.Type == "ssh" {
+		var err error
+		r, err = vs.NewRunner()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+	}
+
+	var err error
+	for _, ip := range ips {
+		for _, port := range p.Ports {
+			if r != nil {
+				err = p.probeRouter(r, ip, port)
+			} else {
+				err = p.probeLocal(ip, port)
+			}
+			if err == nil {
+				log.Printf("%s %s:%d is answering", p.Protocol, ip, port)
+				return nil
+			}
+			log.Printf("%s %s:%d did not answer: %s", p.Protocol, ip, port, err.Error())
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("no IP addresses to probe")
+	}
+	return err
+}
+
+func (p *Probe) probeLocal(ip string, port int) error {
+	addr := net.JoinHostPort(ip, strconv.Itoa(port))
+	if p.Protocol == "tcp" {
+		conn, err := net.DialTimeout("tcp", addr, p.Timeout)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+		return nil
+	}
+
+	payload, err := p.payload(port)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("udp", addr, p.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(p.Timeout))
+	if _, err = conn.Write(payload); err != nil {
+		return err
+	}
+	buf := make([]byte, 1500)
+	// any reply from an IKE or OpenVPN server means it is alive
+	_, err = conn.Read(buf)
+	return err
+}
+
+/*
+ * Run the probe on the router.  Success is the command exiting 0.
+ */
+func (p *Probe) probeRouter(r Runner, ip string, port int) error {
+	pt := ProbeTemplate{
+		IP:       ip,
+		Port:     port,
+		Protocol: p.Protocol,
+		Timeout:  int(p.Timeout.Seconds()),
+	}
+	cmdTmpl := p.RouterCommand
+	switch p.Protocol {
+	case "wireguard":
+		// GetProbe() makes sure we have a router_command
+	case "tcp":
+		if len(cmdTmpl) == 0 {
+			cmdTmpl = defaultRouterProbeCommands["tcp"]
+		}
+	default:
+		payload, err := p.payload(port)
+		if err != nil {
+			return err
+		}
+		var esc bytes.Buffer
+		for _, b := range payload {
+			fmt.Fprintf(&esc, "\\%03o", b)
+		}
+		pt.Payload = esc.String()
+		if len(cmdTmpl) == 0 {
+			cmdTmpl = defaultRouterProbeCommands["udp"]
+		}
+	}
+
+	t, err := template.New("preflight.router_command").Parse(cmdTmpl)
+	if err != nil {
+		return err
+	}
+	var cmd bytes.Buffer
+	if err = t.Execute(&cmd, pt); err != nil {
+		return err
+	}
+	_, err = r.Run(cmd.String())
+	return err
+}
+
+/*
+ * Builds the request packet for UDP protocols
+ */
+func (p *Probe) payload(port int) ([]byte, error) {
+	switch p.Protocol {
+	case "ike":
+		pkt, err := ikeSaInit()
+		if err != nil {
+			return nil, err
+		}
+		if port == 4500 {
+			// NAT-T requires a non-ESP marker
+			pkt = append([]byte{0, 0, 0, 0}, pkt...)
+		}
+		return pkt, nil
+	case "openvpn":
+		return openvpnHardReset()
+	}
+	return nil, fmt.Errorf("Unsupported probe protocol: %s", p.Protocol)
+}
+
+/*
+ * Minimal IKEv2 IKE_SA_INIT request: AES-CBC-128/HMAC-SHA1/MODP2048.
+ * We don't care if the server likes our proposal, only that it answers.
+ */
+func ikeSaInit() ([]byte, error) {
+	spi := make([]byte, 8)
+	ke := make([]byte, 256) // MODP2048 public value
+	nonce := make([]byte, 32)
+	for _, b := range [][]byte{spi, ke, nonce} {
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+	}
+
+	transform := func(last bool, ttype byte, id uint16, attr []byte) []byte {
+		t := []byte{3, 0, 0, 0, ttype, 0, 0, 0}
+		if last {
+			t[0] = 0
+		}
+		binary.BigEndian.PutUint16(t[6:], id)
+		t = append(t, attr...)
+		binary.BigEndian.PutUint16(t[2:], uint16(len(t)))
+		return t
+	}
+	transforms := bytes.Join([][]byte{
+		transform(false, 1, 12, []byte{0x80, 0x0e, 0x00, 0x80}), // ENCR_AES_CBC, 128 bit key
+		transform(false, 2, 2, nil),                             // PRF_HMAC_SHA1
+		transform(false, 3, 2, nil),                             // AUTH_HMAC_SHA1_96
+		transform(true, 4, 14, nil),                             // MODP2048
+	}, nil)
+	proposal := append([]byte{0, 0, 0, 0, 1, 1, 0, 4}, transforms...)
+	binary.BigEndian.PutUint16(proposal[2:], uint16(len(proposal)))
+
+	payload := func(next byte, body []byte) []byte {
+		pl := append([]byte{next, 0, 0, 0}, body...)
+		binary.BigEndian.PutUint16(pl[2:], uint16(len(pl)))
+		return pl
+	}
+	sa := payload(34, proposal)                            // next: KE
+	kex := payload(40, append([]byte{0, 14, 0, 0}, ke...)) // next: Nonce
+	nc := payload(0, nonce)
+
+	hdr := make([]byte, 28)
+	copy(hdr, spi)
+	hdr[16] = 33   // next payload: SA
+	hdr[17] = 0x20 // IKEv2
+	hdr[18] = 34   // IKE_SA_INIT
+	hdr[19] = 0x08 // initiator
+	pkt := bytes.Join([][]byte{hdr, sa, kex, nc}, nil)
+	binary.BigEndian.PutUint32(pkt[24:], uint32(len(pkt)))
+	return pkt, nil
+}
+
+/*
+ * OpenVPN P_CONTROL_HARD_RESET_CLIENT_V2 with key id 0.  Servers using
+ * tls-auth/tls-crypt will silently drop this, so use `tcp` for those.
+ */
+func openvpnHardReset() ([]byte, error) {
+	sid := make([]byte, 8)
+	if _, err := rand.Read(sid); err != nil {
+		return nil, err
+	}
+	pkt := []byte{7 << 3}
+	pkt = append(pkt, sid...)
+	pkt = append(pkt, 0)          // no acks
+	pkt = append(pkt, 0, 0, 0, 0) // packet id
+	return pkt, nil
+}
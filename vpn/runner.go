@@ -0,0 +1,173 @@
+package vpn
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"text/template"
+
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/grignaak/tribool.v1"
+)
+
+/*
+ * A Runner executes commands on the router.  This lets the switch
+ * logic (restart, reload, make-before-break) be written once instead
+ * of once for local and once for ssh.
+ */
+type Runner interface {
+	Run(command string) (bytes.Buffer, error)
+	Close()
+}
+
+type localRunner struct{}
+
+func (r *localRunner) Run(command string) (bytes.Buffer, error) {
+	return execLocalCommand(command)
+}
+
+func (r *localRunner) Close() {}
+
+type sshRunner struct {
+	conn *ssh.Client
+}
+
+func (r *sshRunner) Run(command string) (bytes.Buffer, error) {
+	return execSshCommand(r.conn, command)
+}
+
+func (r *sshRunner) Close() {
+	r.conn.Close()
+}
+
+/*
+ * Returns a Runner for our router.  Callers must Close() it when done.
+ */
+func (vs *VpnServer) NewRunner() (Runner, error) {
+	if vs.Type == "ssh" {
+		router, config := vs.sshConfig()
+		conn, err := ssh.Dial("tcp", router, &config)
+		if err != nil {
+			return nil, err
+		}
+		return &sshRunner{conn: conn}, nil
+	} else if vs.Type == "local" {
+		return &localRunner{}, nil
+	}
+	return nil, fmt.Errorf("Unsupported VpnServer.Type: %s", vs.Type)
+}
+
+/*
+ * Returns the command(s) for the given config key.  Commands can either
+ * be a single string or a list of strings which are run in order.
+ */
+func (vs *VpnServer) commands(key string) []string {
+	cmds := vs.Konf.Strings(key)
+	if len(cmds) == 0 && len(vs.Konf.String(key)) > 0 {
+		cmds = []string{vs.Konf.String(key)}
+	}
+	return cmds
+}
+
+/*
+ * Renders and runs all the commands for the given config key
+ * Returns the output of the last command
+ */
+func (vs *VpnServer) runCommands(r Runner, key string) (bytes.Buffer, error) {
+	var out bytes.Buffer
+	for _, tmpl := range vs.commands(key) {
+		cmd, err := vs.renderGsTemplate(key, tmpl)
+		if err != nil {
+			return out, err
+		}
+		out, err = r.Run(cmd)
+		if err != nil {
+			return out, err
+		}
+	}
+	return out, nil
+}
+
+/*
+ * Runs the `check.command` and looks for `check.match`
+ */
+func (vs *VpnServer) checkUp(r Runner) tribool.Tribool {
+	tmpl := vs.Konf.String("router.check.command")
+	cmd, err := vs.renderGsTemplate("check.command", tmpl)
+	if err != nil {
+		log.Printf("Unable to render template: %s", tmpl)
+		return tribool.Maybe
+	}
+	log.Printf("running %s\n", cmd)
+	out, err := r.Run(cmd)
+	if err != nil {
+		log.Printf("error running: %s\n", cmd)
+		return tribool.False
+	}
+	if bytes.Contains(out.Bytes(), []byte(vs.Konf.String("router.check.match"))) {
+		log.Printf("Matched!\n")
+		return tribool.True
+	}
+	log.Printf("No match :(\n")
+	return tribool.False
+}
+
+/*
+ * Runs the command(s) for the given config key on the router
+ */
+func (vs *VpnServer) RunCommands(key string) (bytes.Buffer, error) {
+	r, err := vs.NewRunner()
+	if err != nil {
+		var buf bytes.Buffer
+		return buf, err
+	}
+	defer r.Close()
+	return vs.runCommands(r, key)
+}
+
+/*
+ * Renders each command template with data and runs it.  For features
+ * which need more than the VpnServer in their templates.
+ * Returns the output of the last command
+ */
+func runTemplates(r Runner, name string, tmpls []string, data interface{}) (bytes.Buffer, error) {
+	var out bytes.Buffer
+	for _, tmpl := range tmpls {
+		t, err := template.New(name).Parse(tmpl)
+		if err != nil {
+			return out, err
+		}
+		var cmd bytes.Buffer
+		if err = t.Execute(&cmd, data); err != nil {
+			return out, err
+		}
+		out, err = r.Run(cmd.String())
+		if err != nil {
+			return out, fmt.Errorf("`%s` failed: %s %s", cmd.String(), err.Error(), out.String())
+		}
+	}
+	return out, nil
+}
+
+/*
+ * Runs the command templates on the router, rendered with data
+ */
+func (vs *VpnServer) RunTemplates(name string, tmpls []string, data interface{}) (bytes.Buffer, error) {
+	r, err := vs.NewRunner()
+	if err != nil {
+		var buf bytes.Buffer
+		return buf, err
+	}
+	defer r.Close()
+	return runTemplates(r, name, tmpls, data)
+}
+
+/*
+ * Returns the command(s) for the config key or the defaults if unset
+ */
+func (vs *VpnServer) CommandsOr(key string, defaults ...string) []string {
+	if cmds := vs.commands(key); len(cmds) > 0 {
+		return cmds
+	}
+	return defaults
+}
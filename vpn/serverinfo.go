@@ -0,0 +1,43 @@
+package vpn
+
+/*
+ * Metadata of a server from the vendor's `servers` config.  Servers can
+ * be a plain hostname/IP or a map with a `host` and any of the other
+ * fields.  The config template gets it as `Server` (and each of the `Hops`
+ * as `.Server`), the command templates as `Info`.
+ */
+type ServerInfo struct {
+	Host      string
+	Name      string            `json:",omitempty"` // display name
+	Protocols []string          `json:",omitempty"` // ie: ikev2, openvpn-udp
+	Port      int               `json:",omitempty"`
+	Tags      []string          `json:",omitempty"` // ie: p2p, streaming, static-ip
+	Latitude  float64           `json:",omitempty"`
+	Longitude float64           `json:",omitempty"`
+	Load      int               `json:",omitempty"` // % load reported by the vendor
+	Enabled   bool              // false if it must not be selected
+	Vars      map[string]string `json:",omitempty"` // free form, for the templates
+}
+
+/*
+ * The info of a server which was given as a plain string
+ */
+func NewServerInfo(host string) ServerInfo {
+	return ServerInfo{Host: host, Enabled: true}
+}
+
+func (si ServerInfo) DisplayName() string {
+	if len(si.Name) > 0 {
+		return si.Name
+	}
+	return si.Host
+}
+
+func (si ServerInfo) HasTag(tag string) bool {
+	for _, t := range si.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -5,13 +5,10 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"strings"
-	"time"
 
 	scp "github.com/bramvdbogaerde/go-scp"
 	"github.com/bramvdbogaerde/go-scp/auth"
 	"golang.org/x/crypto/ssh"
-	"gopkg.in/grignaak/tribool.v1"
 )
 
 /*
@@ -19,7 +16,10 @@ import (
  */
 func (vs *VpnServer) updateConfigSsh() error {
 
-	configFile := vs.Konf.String("router.config_file")
+	configFile, err := vs.configFile()
+	if err != nil {
+		return err
+	}
 
 	cfile, err := vs.createConfig()
 	if err != nil {
@@ -29,11 +29,17 @@ func (vs *VpnServer) updateConfigSsh() error {
 	defer os.Remove(cfile)
 
 	log.Printf("createConfig: %s", cfile)
+	return vs.copyFileSsh(cfile, configFile)
+}
 
+/*
+ * Copies a local file to the router via scp
+ */
+func (vs *VpnServer) copyFileSsh(src string, dst string) error {
 	router, clientConfig := vs.sshConfig()
 	client := scp.NewClient(router, &clientConfig)
 
-	err = client.Connect()
+	err := client.Connect()
 	if err != nil {
 		log.Printf("client.Connect() failed")
 		return err
@@ -42,15 +48,15 @@ func (vs *VpnServer) updateConfigSsh() error {
 
 	defer client.Close()
 
-	f, _ := os.Open(cfile)
+	f, _ := os.Open(src)
 	defer f.Close()
 
-	err = client.CopyFile(f, configFile, "0644")
+	err = client.CopyFile(f, dst, "0644")
 	if err != nil {
 		log.Printf("failed client.CopyFile() %s", err.Error())
 		return err
 	}
-	log.Printf("Success copying %s to %s/%s", cfile, router, configFile)
+	log.Printf("Success copying %s to %s/%s", src, router, dst)
 
 	return nil
 }
@@ -69,35 +75,6 @@ func (vs *VpnServer) sshConfig() (string, ssh.ClientConfig) {
 	return router, clientConfig
 }
 
-func (vs *VpnServer) getUpSsh() tribool.Tribool {
-	router, config := vs.sshConfig()
-	conn, _ := ssh.Dial("tcp", router, &config)
-	defer conn.Close()
-	return vs.checkSsh(conn)
-}
-
-func (vs *VpnServer) checkSsh(conn *ssh.Client) tribool.Tribool {
-	tmpl := vs.Konf.String("router.check.command")
-	cmd, err := vs.renderGsTemplate("ssh.check.command", tmpl)
-	if err != nil {
-		log.Printf("Unable to render template: %s", tmpl)
-		return tribool.Maybe
-	}
-
-	log.Printf("running %s\n", cmd)
-	out, err := execSshCommand(conn, cmd)
-	if err != nil {
-		log.Printf("error running: %s\n", cmd)
-		return tribool.False
-	}
-	if strings.Contains(out.String(), vs.Konf.String("router.check.match")) {
-		log.Printf("Matched!\n")
-		return tribool.True
-	}
-	log.Printf("No match :(\n")
-	return tribool.False
-}
-
 func (vs *VpnServer) statusSsh() (bytes.Buffer, error) {
 	var buf bytes.Buffer
 	router, config := vs.sshConfig()
@@ -134,42 +111,3 @@ func execSshCommand(conn *ssh.Client, command string) (bytes.Buffer, error) {
 	}
 	return stdoutBuf, nil
 }
-
-/*
- * SSH to the router and restart IPSec
- */
-func (vs *VpnServer) restartVpnSsh() (bool, error) {
-	var vpnUp bool = false
-
-	router, config := vs.sshConfig()
-	conn, _ := ssh.Dial("tcp", router, &config)
-	defer conn.Close()
-
-	_, err := execSshCommand(conn, vs.Konf.String("router.stop_command"))
-	if err != nil {
-		return vpnUp, err
-	}
-	_, err = execSshCommand(conn, vs.Konf.String("router.start_command"))
-	if err != nil {
-		return vpnUp, err
-	}
-
-	var buf bytes.Buffer
-	for i := 0; i < vs.WaitSeconds; i++ {
-		ret := vs.checkSsh(conn)
-		if ret != tribool.True {
-			duration, _ := time.ParseDuration("1s")
-			time.Sleep(duration)
-			continue
-		} else {
-			vpnUp = true
-			break
-		}
-	}
-	if !vpnUp {
-		return vpnUp, fmt.Errorf(
-			"%s VPN to %s did not come up after %d seconds: %s",
-			vs.Exit, vs.Vendor, vs.WaitSeconds, buf.String())
-	}
-	return vpnUp, nil
-}
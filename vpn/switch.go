@@ -0,0 +1,182 @@
+package vpn
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"gopkg.in/grignaak/tribool.v1"
+)
+
+/*
+ * How we move from one exit to another is controlled by `router.switch_mode`:
+ *
+ * restart:           run `stop_command` and then `start_command` (default)
+ * reload:            run `reload_command` so the VPN reconfigures in place
+ * make_before_break: bring up the new exit on the standby connection,
+ *                    wait for it to be healthy, move the routes and only
+ *                    then tear down the old connection
+ */
+const (
+	SwitchRestart         = "restart"
+	SwitchReload          = "reload"
+	SwitchMakeBeforeBreak = "make_before_break"
+)
+
+func (vs *VpnServer) SwitchMode() string {
+	mode := vs.Konf.String("router.switch_mode")
+	if vs.Fixed && mode == SwitchMakeBeforeBreak {
+		// there is no standby connection to make before we break
+		return SwitchRestart
+	}
+	switch mode {
+	case SwitchReload, SwitchMakeBeforeBreak:
+		return mode
+	case "", SwitchRestart:
+		return SwitchRestart
+	default:
+		log.Printf("Warning: unknown `router.switch_mode` %s, using %s", mode, SwitchRestart)
+		return SwitchRestart
+	}
+}
+
+/*
+ * The two connection names we alternate between in make_before_break mode
+ */
+func (vs *VpnServer) connections() []string {
+	return vs.Konf.Strings("router.make_before_break.connections")
+}
+
+/*
+ * Returns the connection which is not currently active
+ */
+func (vs *VpnServer) standbyConnection() string {
+	conns := vs.connections()
+	if conns[0] == vs.Connection {
+		return conns[1]
+	}
+	return conns[0]
+}
+
+/*
+ * Picks the connection name the next config will be written for
+ */
+func (vs *VpnServer) selectConnection(vendor string) error {
+	if vs.Fixed {
+		return nil
+	}
+	if vs.SwitchMode() != SwitchMakeBeforeBreak {
+		vs.Connection = vendor
+		return nil
+	}
+	if len(vs.connections()) != 2 {
+		return fmt.Errorf("`router.make_before_break.connections` must list two connection names")
+	}
+	vs.PrevConnection = vs.Connection
+	vs.Connection = vs.standbyConnection()
+	return nil
+}
+
+/*
+ * Waits up to WaitSeconds for the `check` command to match
+ */
+func (vs *VpnServer) waitUp(r Runner) bool {
+	for i := 0; i < vs.WaitSeconds; i++ {
+		if vs.checkUp(r) == tribool.True {
+			return true
+		}
+		time.Sleep(time.Second)
+	}
+	return false
+}
+
+func (vs *VpnServer) notUpError() error {
+	return fmt.Errorf(
+		"%s VPN to %s did not come up after %d seconds",
+		vs.Exit, vs.Vendor, vs.WaitSeconds)
+}
+
+/*
+ * Classic stop & start.  Drops all traffic until the VPN is back up.
+ */
+func (vs *VpnServer) restartVpn(r Runner) (bool, error) {
+	_, err := vs.runCommands(r, "router.stop_command")
+	if err != nil {
+		return false, err
+	}
+	_, err = vs.runCommands(r, "router.start_command")
+	if err != nil {
+		return false, err
+	}
+	if !vs.waitUp(r) {
+		return false, vs.notUpError()
+	}
+	return true, nil
+}
+
+/*
+ * Have the VPN re-read the config without stopping the service
+ */
+func (vs *VpnServer) reloadVpn(r Runner) (bool, error) {
+	if len(vs.commands("router.reload_command")) == 0 {
+		return false, fmt.Errorf("`router.switch_mode` is %s, but `router.reload_command` is not set", SwitchReload)
+	}
+	_, err := vs.runCommands(r, "router.reload_command")
+	if err != nil {
+		return false, err
+	}
+	if !vs.waitUp(r) {
+		return false, vs.notUpError()
+	}
+	return true, nil
+}
+
+/*
+ * Bring up the new Connection next to PrevConnection and only move the
+ * routes & tear down PrevConnection once the new one is healthy.  If the
+ * new connection never comes up or the routes can't be moved to it, it is
+ * torn down and we stay on the old one.
+ */
+func (vs *VpnServer) makeBeforeBreak(r Runner) (bool, error) {
+	_, err := vs.runCommands(r, "router.make_before_break.up_command")
+	if err == nil && !vs.waitUp(r) {
+		err = vs.notUpError()
+	}
+	if err != nil {
+		log.Printf("%s failed to come up, staying on %s", vs.Connection, vs.PrevConnection)
+		vs.abandonConnection(r)
+		return false, err
+	}
+
+	_, err = vs.runCommands(r, "router.make_before_break.route_command")
+	if err != nil {
+		log.Printf("Unable to move the routes to %s, staying on %s", vs.Connection, vs.PrevConnection)
+		vs.abandonConnection(r)
+		// put back any routes which were already moved
+		if _, rerr := vs.runCommands(r, "router.make_before_break.route_command"); rerr != nil {
+			log.Printf("Unable to restore the routes to %s: %s", vs.Connection, rerr.Error())
+		}
+		return false, err
+	}
+
+	if len(vs.PrevConnection) > 0 {
+		_, err = vs.runCommands(r, "router.make_before_break.down_command")
+		if err != nil {
+			// the new exit is up and routed, so this isn't fatal
+			log.Printf("Unable to tear down %s: %s", vs.PrevConnection, err.Error())
+		}
+	}
+	return true, nil
+}
+
+/*
+ * Switches back to PrevConnection and tears down the new connection
+ */
+func (vs *VpnServer) abandonConnection(r Runner) {
+	failed := vs.Connection
+	vs.Connection, vs.PrevConnection = vs.PrevConnection, failed
+	if _, err := vs.runCommands(r, "router.make_before_break.down_command"); err != nil {
+		log.Printf("Unable to tear down %s: %s", failed, err.Error())
+	}
+	vs.PrevConnection = ""
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
 	"text/template"
 
 	"github.com/knadh/koanf"
@@ -22,17 +23,28 @@ type VpnServer struct {
 	Username string
 	Password string
 	// These values are modified at runtime
-	Vendor string
-	Exit   string
+	Vendor         string
+	Exit           string
+	Info           ServerInfo // metadata of Exit from the vendor config
+	Connection     string     // connection name the current config is for
+	PrevConnection string     // only set during a make_before_break switch
+	Fixed          bool       // Connection never changes, ie: policy routing tunnels
+	Hops           []Hop      // the multi-hop chain we are on, empty for a single exit
+	PrevHops       []Hop      // only set while switching away from a chain
+	hop            int        // index in Hops of the config being rendered
 }
 
 func NewVpn(konf *koanf.Koanf) *VpnServer {
 	var vs *VpnServer
+	wait := 5
+	if konf.Int("router.wait_seconds") > 0 {
+		wait = konf.Int("router.wait_seconds")
+	}
 	if konf.String("router.mode") == "local" {
 		vs = &VpnServer{
 			Type:        "local",
 			Konf:        konf,
-			WaitSeconds: 5,
+			WaitSeconds: wait,
 			ConfigFile:  konf.String("router.konfig_file"),
 		}
 	} else if konf.String("router.mode") == "ssh" {
@@ -40,45 +52,165 @@ func NewVpn(konf *koanf.Koanf) *VpnServer {
 			Type:        "ssh",
 			Konf:        konf,
 			ConfigFile:  konf.String("router.konfig_file"),
-			WaitSeconds: 5,
+			WaitSeconds: wait,
 			Host:        konf.String("router.host"),
 			Port:        konf.Int("router.port"),
 			Username:    konf.String("router.username"),
 			Password:    konf.String("router.password"),
 		}
 	}
+	if vs != nil && vs.SwitchMode() == SwitchMakeBeforeBreak {
+		// assume the router boots with the first connection
+		conns := vs.connections()
+		if len(conns) > 0 {
+			vs.Connection = conns[0]
+		}
+	}
 	return vs
 }
 
-func (vs *VpnServer) UpdateConfig(vendor string, exit string) error {
+func (vs *VpnServer) UpdateConfig(vendor string, exit string, info ServerInfo) error {
+	saved := vs.Snapshot()
+	err := vs.updateConfig(vendor, exit, info)
+	if err != nil {
+		// we never switched, so keep pointing at what is running
+		if rerr := vs.Rollback(saved); rerr != nil {
+			log.Printf("Unable to restore the previous config: %s", rerr.Error())
+		}
+	}
+	return err
+}
+
+func (vs *VpnServer) updateConfig(vendor string, exit string, info ServerInfo) error {
+	if err := vs.selectConnection(vendor); err != nil {
+		return err
+	}
+	if len(vs.Hops) > 0 {
+		// Restart() tears the chain down
+		vs.PrevHops, vs.Hops, vs.hop = vs.Hops, nil, 0
+	}
+	vs.Vendor = vendor
+	vs.Exit = exit
+	vs.Info = info
+	return vs.writeConfig()
+}
+
+/*
+ * Renders the config for the current Vendor/Exit/Connection
+ */
+func (vs *VpnServer) writeConfig() error {
 	if vs.Type == "ssh" {
-		vs.Vendor = vendor
-		vs.Exit = exit
 		return vs.updateConfigSsh()
 	} else if vs.Type == "local" {
-		vs.Vendor = vendor
-		vs.Exit = exit
 		return vs.updateConfigLocal()
 	}
 	return fmt.Errorf("Unsupported VpnServer.Type: %s", vs.Type)
 }
 
+/*
+ * The fields of VpnServer which are modified at runtime, so a failed
+ * switch can go back to where we were via Rollback()
+ */
+type VpnState struct {
+	vendor         string
+	exit           string
+	info           ServerInfo
+	connection     string
+	prevConnection string
+	hops           []Hop
+	prevHops       []Hop
+	hop            int
+}
+
+func (vs *VpnServer) Snapshot() VpnState {
+	return VpnState{
+		vendor:         vs.Vendor,
+		exit:           vs.Exit,
+		info:           vs.Info,
+		connection:     vs.Connection,
+		prevConnection: vs.PrevConnection,
+		hops:           vs.Hops,
+		prevHops:       vs.PrevHops,
+		hop:            vs.hop,
+	}
+}
+
+func (vs *VpnServer) restoreState(s VpnState) {
+	vs.Vendor = s.vendor
+	vs.Exit = s.exit
+	vs.Info = s.info
+	vs.Connection = s.connection
+	vs.PrevConnection = s.prevConnection
+	vs.Hops = s.hops
+	vs.PrevHops = s.prevHops
+	vs.hop = s.hop
+}
+
+/*
+ * Goes back to the state and renders its configs again, since a failed
+ * UpdateConfig() or UpdateChain() may have overwritten some of them
+ */
+func (vs *VpnServer) Rollback(s VpnState) error {
+	vs.restoreState(s)
+	return vs.writeConfigs()
+}
+
+/*
+ * Renders the config of the exit or each hop of the chain we are on
+ */
+func (vs *VpnServer) writeConfigs() error {
+	if len(vs.Hops) == 0 {
+		if len(vs.Vendor) == 0 {
+			// nothing to go back to
+			return nil
+		}
+		return vs.writeConfig()
+	}
+	saved := vs.Snapshot()
+	defer vs.restoreState(saved)
+	for i := range vs.Hops {
+		vs.selectHop(vs.Hops, i)
+		if err := vs.writeConfig(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (vs *VpnServer) IsUp() (tribool.Tribool, error) {
-	if vs.Type == "ssh" {
-		return vs.getUpSsh(), nil
-	} else if vs.Type == "local" {
-		return vs.getUpLocal(), nil
+	r, err := vs.NewRunner()
+	if err != nil {
+		return tribool.Maybe, err
 	}
-	return tribool.Maybe, fmt.Errorf("Unsupported VpnServer.Type: %s", vs.Type)
+	defer r.Close()
+	return vs.checkUp(r), nil
 }
 
+/*
+ * Apply the new config using the configured `router.switch_mode`
+ */
 func (vs *VpnServer) Restart() (bool, error) {
-	if vs.Type == "ssh" {
-		return vs.restartVpnSsh()
-	} else if vs.Type == "local" {
-		return vs.restartVpnLocal()
+	r, err := vs.NewRunner()
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	if len(vs.Hops) > 0 {
+		return vs.restartChain(r)
+	}
+	if len(vs.PrevHops) > 0 {
+		vs.stopChain(r, vs.PrevHops)
+		vs.PrevHops = nil
+	}
+	switch vs.SwitchMode() {
+	case SwitchReload:
+		return vs.reloadVpn(r)
+	case SwitchMakeBeforeBreak:
+		return vs.makeBeforeBreak(r)
+	default:
+		return vs.restartVpn(r)
 	}
-	return false, fmt.Errorf("Unsupported VpnServer.Type: %s", vs.Type)
 }
 
 func (vs *VpnServer) Status() (bytes.Buffer, error) {
@@ -93,8 +225,14 @@ func (vs *VpnServer) Status() (bytes.Buffer, error) {
 
 // Everything that belongs in the config template needs to be here
 type ConfigTemplate struct {
-	VpnServer string
-	Vendor    string
+	VpnServer  string
+	Vendor     string
+	Server     ServerInfo // port, protocols, vars, etc of VpnServer
+	Connection string
+	Hops       []HopTemplate // every hop of a multi-hop chain, outer first
+	Hop        int           // index in Hops of this config
+	IPv4       []string      // addresses of VpnServer allowed by `<vendor>.address_family`
+	IPv6       []string
 }
 
 /*
@@ -104,9 +242,14 @@ type ConfigTemplate struct {
 func (vs *VpnServer) createConfig() (string, error) {
 	tmpl := vs.Konf.String(vs.Vendor + ".config_template")
 	conf := ConfigTemplate{
-		VpnServer: vs.Exit,
-		Vendor:    vs.Vendor,
+		VpnServer:  vs.Exit,
+		Vendor:     vs.Vendor,
+		Server:     vs.Info,
+		Connection: vs.Connection,
+		Hops:       vs.hopTemplates(),
+		Hop:        vs.hop,
 	}
+	conf.IPv4, conf.IPv6 = vs.exitAddrs(vs.Vendor, vs.Exit)
 	tfile, err := template.ParseFiles(tmpl)
 	if err != nil {
 		return "", err
@@ -125,6 +268,63 @@ func (vs *VpnServer) createConfig() (string, error) {
 	return out.Name(), nil
 }
 
+/*
+ * The IPv4 & IPv6 addresses of the exit
+ */
+func (vs *VpnServer) exitAddrs(vendor string, exit string) ([]string, []string) {
+	addrs, err := ResolveHost(exit, AddressFamily(vs.Konf, vendor))
+	if err != nil {
+		log.Printf("Unable to resolve %s: %s", exit, err.Error())
+	}
+	return SplitFamilies(addrs)
+}
+
+/*
+ * Moves a local (temp) file to dst on the router
+ */
+func (vs *VpnServer) installFile(src string, dst string) error {
+	if vs.Type == "ssh" {
+		defer os.Remove(src)
+		return vs.copyFileSsh(src, dst)
+	} else if vs.Type == "local" {
+		err := os.Rename(src, dst)
+		if err == nil {
+			log.Printf("Success moving %s to %s", src, dst)
+		}
+		return err
+	}
+	return fmt.Errorf("Unsupported VpnServer.Type: %s", vs.Type)
+}
+
+/*
+ * Renders the template text with data and installs it as dst on the router
+ */
+func (vs *VpnServer) DeployTemplate(name string, tmpl string, data interface{}, dst string) error {
+	t, err := template.New(name).Parse(tmpl)
+	if err != nil {
+		return err
+	}
+	out, err := ioutil.TempFile("", "vpnexiter")
+	if err != nil {
+		return err
+	}
+	err = t.Execute(out, data)
+	out.Close()
+	if err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	return vs.installFile(out.Name(), dst)
+}
+
+/*
+ * Path of the config file on the router.  May use `{{.Connection}}` so
+ * make_before_break can write one file per connection.
+ */
+func (vs *VpnServer) configFile() (string, error) {
+	return vs.renderGsTemplate("config_file", vs.Konf.String("router.config_file"))
+}
+
 /*
  * Shared function for ssh to do variable interpolation for
  * commands.  Users can use `Vendor`, `Exit` or any